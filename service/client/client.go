@@ -0,0 +1,511 @@
+// Package client talks to the mail watcher service over its control socket.
+//
+// A Client keeps a connection open in the background, performs the Hello
+// handshake and reconnects with a backoff whenever the connection drops.
+// Subscriptions are sent again after every reconnect.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mailcode/service/internal/mailwatcher"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const DefaultSocketPath = "/tmp/mailwatcher.sock"
+
+// Protocol types, so that users of this package can name them
+type (
+	Message           = mailwatcher.Message
+	Error             = mailwatcher.Error
+	FieldError        = mailwatcher.FieldError
+	HelloReply        = mailwatcher.HelloReply
+	AddRequest        = mailwatcher.AddRequest
+	TLSSettings       = mailwatcher.TLSSettings
+	SubscribeRequest  = mailwatcher.SubscribeRequest
+	MailboxInfo       = mailwatcher.MailboxInfo
+	MailboxStatus     = mailwatcher.MailboxStatusInfo
+	CodeEvent         = mailwatcher.CodeEvent
+	LinkEvent         = mailwatcher.LinkEvent
+	EmailInfo         = mailwatcher.EmailInfo
+	MailboxStateEvent = mailwatcher.MailboxStateEvent
+	ErrorCode         = mailwatcher.ErrorCode
+)
+
+// Values of Error.Code
+const (
+	ErrInvalidMessage     = mailwatcher.ErrInvalidMessage
+	ErrInvalidAction      = mailwatcher.ErrInvalidAction
+	ErrInvalidParams      = mailwatcher.ErrInvalidParams
+	ErrNotFound           = mailwatcher.ErrNotFound
+	ErrInternal           = mailwatcher.ErrInternal
+	ErrHandshakeRequired  = mailwatcher.ErrHandshakeRequired
+	ErrUnsupportedVersion = mailwatcher.ErrUnsupportedVersion
+)
+
+var (
+	ErrClosed       = errors.New("client closed")
+	ErrDisconnected = errors.New("connection to the service lost")
+)
+
+type Options struct {
+	// Defaults to DefaultSocketPath
+	Path string
+	// Sent right after connecting and after every reconnect. Nil receives
+	// every event.
+	Subscription *SubscribeRequest
+	// Delay before the first reconnect attempt, doubled after every failed
+	// attempt up to MaxBackoff. Default to 100ms and 10s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Size of the event channels. Defaults to 64.
+	EventBuffer int
+}
+
+type Client struct {
+	opts Options
+
+	codes  *eventQueue[CodeEvent]
+	links  *eventQueue[LinkEvent]
+	states chan MailboxStateEvent
+
+	mux     sync.Mutex
+	conn    net.Conn
+	hello   HelloReply
+	sub     *SubscribeRequest
+	pending map[string]chan Message
+	nextID  uint64
+	// Closed and replaced every time the connection is established or lost
+	connChanged chan struct{}
+	err         error
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Dial connects to the service and performs the handshake. ctx only bounds
+// the initial connection, the client stays connected until Close is called.
+func Dial(ctx context.Context, opts Options) (*Client, error) {
+	if opts.Path == "" {
+		opts.Path = DefaultSocketPath
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 100 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 10 * time.Second
+	}
+	if opts.EventBuffer <= 0 {
+		opts.EventBuffer = 64
+	}
+
+	c := &Client{
+		opts:        opts,
+		codes:       newEventQueue[CodeEvent](opts.EventBuffer),
+		links:       newEventQueue[LinkEvent](opts.EventBuffer),
+		states:      make(chan MailboxStateEvent, opts.EventBuffer),
+		sub:         opts.Subscription,
+		pending:     map[string]chan Message{},
+		connChanged: make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.wg.Add(3)
+	go c.run(conn)
+	go c.codes.forward(&c.wg, c.done)
+	go c.links.forward(&c.wg, c.done)
+	return c, nil
+}
+
+// Close disconnects from the service and closes the event channels
+func (c *Client) Close() error {
+	c.mux.Lock()
+	select {
+	case <-c.done:
+		c.mux.Unlock()
+		return nil
+	default:
+	}
+	close(c.done)
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.mux.Unlock()
+
+	c.wg.Wait()
+	return nil
+}
+
+// Codes delivers every code event the connection is subscribed to. Codes are
+// never dropped: while the channel is full they are queued in memory, so it
+// should still be drained.
+func (c *Client) Codes() <-chan CodeEvent {
+	return c.codes.out
+}
+
+// Links delivers the verification links the connection is subscribed to.
+// Like codes, links are queued while the channel is full. Clients that only
+// want codes can subscribe to Code events alone.
+func (c *Client) Links() <-chan LinkEvent {
+	return c.links.out
+}
+
+// States delivers mailbox state changes and errors. Events are dropped while
+// the channel is full.
+func (c *Client) States() <-chan MailboxStateEvent {
+	return c.states
+}
+
+// Hello returns what the service advertised during the last handshake
+func (c *Client) Hello() HelloReply {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.hello
+}
+
+// connect dials the service, performs the handshake and sends the current
+// subscription before any event can be missed.
+func (c *Client) connect(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", c.opts.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing else reads from conn yet, so replies can be read in place
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	hello, err := mailwatcher.NewRequest("hello", mailwatcher.Hello, mailwatcher.HelloRequest{Version: mailwatcher.ProtocolVersion})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reply, err := roundTrip(conn, &hello)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	helloReply := HelloReply{}
+	if err := mailwatcher.UnmarshalParams(&reply, &helloReply); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c.mux.Lock()
+	sub := c.sub
+	c.mux.Unlock()
+	if sub != nil {
+		msg, err := mailwatcher.NewRequest("subscribe", mailwatcher.Subscribe, sub)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if _, err := roundTrip(conn, &msg); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.mux.Lock()
+	select {
+	case <-c.done:
+		c.mux.Unlock()
+		conn.Close()
+		return nil, ErrClosed
+	default:
+	}
+	c.conn = conn
+	c.hello = helloReply
+	close(c.connChanged)
+	c.connChanged = make(chan struct{})
+	c.mux.Unlock()
+	return conn, nil
+}
+
+// roundTrip writes msg and reads until its reply. Only used while nothing
+// else reads from conn. Replayed codes that arrive after the reply are left
+// for the read loop.
+func roundTrip(conn net.Conn, msg *Message) (Message, error) {
+	if err := mailwatcher.WriteMessage(conn, msg); err != nil {
+		return Message{}, err
+	}
+	for {
+		reply, err := mailwatcher.ReadMessage(conn)
+		if err != nil {
+			return reply, err
+		}
+		if reply.Type != mailwatcher.Reply || reply.ID != msg.ID {
+			continue
+		}
+		if reply.Error != nil {
+			return reply, reply.Error
+		}
+		return reply, nil
+	}
+}
+
+func (c *Client) run(conn net.Conn) {
+	defer c.wg.Done()
+	defer close(c.states)
+
+	for {
+		err := c.readLoop(conn)
+		c.disconnected(err)
+
+		conn = c.reconnect()
+		if conn == nil {
+			return
+		}
+	}
+}
+
+func (c *Client) readLoop(conn net.Conn) error {
+	for {
+		msg, err := mailwatcher.ReadMessage(conn)
+		if err != nil {
+			return err
+		}
+
+		switch msg.Type {
+		case mailwatcher.Reply:
+			c.mux.Lock()
+			ch, ok := c.pending[msg.ID]
+			delete(c.pending, msg.ID)
+			c.mux.Unlock()
+			if ok {
+				ch <- msg
+			}
+		case mailwatcher.Event:
+			c.dispatch(&msg)
+		}
+	}
+}
+
+func (c *Client) dispatch(msg *Message) {
+	switch msg.Cmd {
+	case mailwatcher.Code:
+		ev := CodeEvent{}
+		if err := mailwatcher.UnmarshalParams(msg, &ev); err != nil {
+			return
+		}
+		c.codes.push(ev)
+	case mailwatcher.Link:
+		ev := LinkEvent{}
+		if err := mailwatcher.UnmarshalParams(msg, &ev); err != nil {
+			return
+		}
+		c.links.push(ev)
+	case mailwatcher.StateChanged, mailwatcher.ConnectionError:
+		ev := MailboxStateEvent{}
+		if err := mailwatcher.UnmarshalParams(msg, &ev); err != nil {
+			return
+		}
+		select {
+		case c.states <- ev:
+		default:
+		}
+	}
+}
+
+// eventQueue holds events until the application takes them from out, so
+// that reading from the service never waits for the application
+type eventQueue[T any] struct {
+	out    chan T
+	mux    sync.Mutex
+	queued []T
+	signal chan struct{}
+}
+
+func newEventQueue[T any](size int) *eventQueue[T] {
+	return &eventQueue[T]{
+		out:    make(chan T, size),
+		signal: make(chan struct{}, 1),
+	}
+}
+
+func (q *eventQueue[T]) push(ev T) {
+	q.mux.Lock()
+	q.queued = append(q.queued, ev)
+	q.mux.Unlock()
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+// forward moves queued events to out as the application takes them, and
+// closes out once done is
+func (q *eventQueue[T]) forward(wg *sync.WaitGroup, done chan struct{}) {
+	defer wg.Done()
+	defer close(q.out)
+
+	for {
+		q.mux.Lock()
+		if len(q.queued) == 0 {
+			q.mux.Unlock()
+			select {
+			case <-q.signal:
+				continue
+			case <-done:
+				return
+			}
+		}
+		ev := q.queued[0]
+		q.queued = q.queued[1:]
+		q.mux.Unlock()
+
+		select {
+		case q.out <- ev:
+		case <-done:
+			return
+		}
+	}
+}
+
+// disconnected fails every request that is still waiting for a reply
+func (c *Client) disconnected(err error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	for id, ch := range c.pending {
+		ch <- Message{ID: id, Type: mailwatcher.Reply, Error: &Error{
+			Code:    ErrInternal,
+			Message: fmt.Sprintf("%s: %s", ErrDisconnected, err),
+		}}
+		delete(c.pending, id)
+	}
+	close(c.connChanged)
+	c.connChanged = make(chan struct{})
+}
+
+// reconnect retries until it is connected or the client is closed, in which
+// case it returns nil. A service that rejects the client's protocol version
+// won't accept it on the next attempt either, so that ends the client too.
+func (c *Client) reconnect() net.Conn {
+	backoff := c.opts.MinBackoff
+	for {
+		select {
+		case <-c.done:
+			return nil
+		case <-time.After(backoff):
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-c.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		conn, err := c.connect(ctx)
+		cancel()
+
+		if err == nil {
+			return conn
+		}
+
+		var e *Error
+		if errors.As(err, &e) && e.Code == mailwatcher.ErrUnsupportedVersion {
+			c.mux.Lock()
+			c.err = err
+			c.mux.Unlock()
+			return nil
+		}
+
+		backoff = min(backoff*2, c.opts.MaxBackoff)
+	}
+}
+
+// request sends a request once connected and decodes its reply into result,
+// unless result is nil.
+func (c *Client) request(ctx context.Context, cmd mailwatcher.Action, params interface{}, result interface{}) error {
+	for {
+		c.mux.Lock()
+		select {
+		case <-c.done:
+			err := c.err
+			c.mux.Unlock()
+			if err != nil {
+				return err
+			}
+			return ErrClosed
+		default:
+		}
+		conn := c.conn
+		changed := c.connChanged
+		if conn != nil {
+			break
+		}
+		c.mux.Unlock()
+
+		// Wait for the read loop to reconnect
+		select {
+		case <-changed:
+		case <-c.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	c.nextID++
+	id := strconv.FormatUint(c.nextID, 10)
+	replies := make(chan Message, 1)
+	c.pending[id] = replies
+	conn := c.conn
+	c.mux.Unlock()
+
+	msg, err := mailwatcher.NewRequest(id, cmd, params)
+	if err == nil {
+		err = mailwatcher.WriteMessage(conn, &msg)
+	}
+	if err != nil {
+		c.forget(id)
+		return err
+	}
+
+	select {
+	case reply := <-replies:
+		if reply.Error != nil {
+			return reply.Error
+		}
+		if result == nil {
+			return nil
+		}
+		return mailwatcher.UnmarshalParams(&reply, result)
+	case <-ctx.Done():
+		c.forget(id)
+		return ctx.Err()
+	case <-c.done:
+		return ErrClosed
+	}
+}
+
+func (c *Client) forget(id string) {
+	c.mux.Lock()
+	delete(c.pending, id)
+	c.mux.Unlock()
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"context"
+	"mailcode/service/internal/mailwatcher"
+)
+
+func (c *Client) Add(ctx context.Context, req AddRequest) error {
+	return c.request(ctx, mailwatcher.Add, req, nil)
+}
+
+func (c *Client) Remove(ctx context.Context, email string) error {
+	return c.request(ctx, mailwatcher.Remove, mailwatcher.MailboxRequest{Email: email}, nil)
+}
+
+func (c *Client) Watch(ctx context.Context, email string) error {
+	return c.request(ctx, mailwatcher.Watch, mailwatcher.MailboxRequest{Email: email}, nil)
+}
+
+func (c *Client) WatchAll(ctx context.Context) error {
+	return c.request(ctx, mailwatcher.WatchAll, nil, nil)
+}
+
+func (c *Client) Stop(ctx context.Context, email string) error {
+	return c.request(ctx, mailwatcher.Stop, mailwatcher.MailboxRequest{Email: email}, nil)
+}
+
+func (c *Client) StopAll(ctx context.Context) error {
+	return c.request(ctx, mailwatcher.StopAll, nil, nil)
+}
+
+func (c *Client) GetMailbox(ctx context.Context, email string) (MailboxInfo, error) {
+	mb := MailboxInfo{}
+	err := c.request(ctx, mailwatcher.GetMailbox, mailwatcher.MailboxRequest{Email: email}, &mb)
+	return mb, err
+}
+
+func (c *Client) GetAllMailboxes(ctx context.Context) ([]MailboxInfo, error) {
+	list := mailwatcher.MailboxList{}
+	err := c.request(ctx, mailwatcher.GetAllMailboxes, nil, &list)
+	return list.Emails, err
+}
+
+// Status of a single mailbox, or of every mailbox if email is empty
+func (c *Client) Status(ctx context.Context, email string) ([]MailboxStatus, error) {
+	status := mailwatcher.StatusReply{}
+	err := c.request(ctx, mailwatcher.Status, mailwatcher.StatusRequest{Email: email}, &status)
+	return status.Mailboxes, err
+}
+
+// Subscribe replaces the current subscription, also for future reconnects.
+// Codes and links that are still valid and match it are delivered on Codes
+// and Links again.
+func (c *Client) Subscribe(ctx context.Context, req SubscribeRequest) error {
+	if err := c.request(ctx, mailwatcher.Subscribe, req, nil); err != nil {
+		return err
+	}
+	c.mux.Lock()
+	c.sub = &req
+	c.mux.Unlock()
+	return nil
+}
+
+// RecentCodes returns the codes that are still valid, for a single mailbox
+// or for every mailbox if mailbox is empty
+func (c *Client) RecentCodes(ctx context.Context, mailbox string) ([]CodeEvent, error) {
+	recent := mailwatcher.RecentCodesReply{}
+	err := c.request(ctx, mailwatcher.RecentCodes, mailwatcher.RecentCodesRequest{Mailbox: mailbox}, &recent)
+	return recent.Codes, err
+}
+
+// RecentLinks is RecentCodes for verification links
+func (c *Client) RecentLinks(ctx context.Context, mailbox string) ([]LinkEvent, error) {
+	recent := mailwatcher.RecentCodesReply{}
+	err := c.request(ctx, mailwatcher.RecentCodes, mailwatcher.RecentCodesRequest{Mailbox: mailbox}, &recent)
+	return recent.Links, err
+}
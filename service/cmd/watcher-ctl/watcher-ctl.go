@@ -1,15 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"mailcode/service/client"
 	"mailcode/service/internal/controller"
 	"mailcode/service/internal/mailwatcher"
-	"net"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 )
 
 func main() {
@@ -20,15 +22,27 @@ func main() {
 	var listFlag = flag.Bool("list", false, "List the current emails")
 	var addFlag = flag.Bool("add", false, "Add a new email to the list")
 	var deleteFlag = flag.Bool("delete", false, "Remove email from the list")
+	var statusFlag = flag.Bool("status", false, "Print the watcher's status for every email, or only for -email")
 
-	var sendMsgFlag = flag.String("msg", "", "Message to send")
+	var sendMsgFlag = flag.String("msg", "", "Command to send to the service: Watch, WatchAll, Stop or StopAll")
 
 	// Mailbox info
 	var emailFlag = flag.String("email", "", "")
 	var passwordFlag = flag.String("password", "", "")
 	var serverFlag = flag.String("server", "", "")
-	var useTLSFlag = flag.Bool("with-tls", true, "")
+	var tlsFlag = flag.String("tls", "implicit", "How the connection is secured: implicit, starttls or plaintext")
+	var useTLSFlag = flag.Bool("with-tls", true, "Deprecated: use -tls. False is the same as -tls plaintext")
+	var tlsCAFlag = flag.String("tls-ca", "", "PEM file of the CAs to trust instead of the system's")
+	var tlsPinsFlag = flag.String("tls-pin", "", "Comma separated SHA-256 fingerprints, one of which must be in the server's certificate chain")
+	var tlsMinFlag = flag.String("tls-min", "", "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	var tlsCertFlag = flag.String("tls-cert", "", "PEM file of a client certificate")
+	var tlsKeyFlag = flag.String("tls-key", "", "PEM file of the client certificate's key, if it isn't in -tls-cert")
 	var portFlag = flag.Int("port", 0, "")
+	var noIdleFlag = flag.Bool("no-idle", false, "Poll for new emails even if the server supports IDLE")
+	var actionsFlag = flag.String("actions", "", "Comma separated actions for emails with codes: none, seen, keyword:<keyword>, move:<folder>, delete[:<delay>]")
+	var foldersFlag = flag.String("folders", "", "Comma separated folders to watch. Defaults to INBOX, the junk folder is always watched")
+	var oauthFlag = flag.String("oauth", "", "Sign in with this OAuth2 provider of the config instead of a password")
+	var oauthFlowFlag = flag.String("oauth-flow", "code", "How to sign in with -oauth: code opens a browser, device shows a code to enter on another device")
 
 	flag.Parse()
 
@@ -63,13 +77,64 @@ func main() {
 
 	if *addFlag {
 		mb := mailwatcher.Mailbox{
-			Email:    *emailFlag,
-			Password: *passwordFlag,
-			Server:   *serverFlag,
-			Port:     int32(*portFlag),
-			UseSSL:   *useTLSFlag,
+			Email:       *emailFlag,
+			Password:    *passwordFlag,
+			Server:      *serverFlag,
+			Port:        int32(*portFlag),
+			DisableIdle: *noIdleFlag,
+			TLS: mailwatcher.TLSOptions{
+				CAFile:     *tlsCAFlag,
+				ClientCert: *tlsCertFlag,
+				ClientKey:  *tlsKeyFlag,
+			},
+		}
+		if mb.TLS.Mode, err = mailwatcher.ParseTLSMode(*tlsFlag); err != nil {
+			log.Fatalln(err)
+		}
+		if isFlagSet("with-tls") {
+			if isFlagSet("tls") && *useTLSFlag != (mb.TLS.Mode != mailwatcher.TLSPlaintext) {
+				log.Fatalf("-with-tls=%t conflicts with -tls %s\n", *useTLSFlag, mb.TLS.Mode.ToString())
+			}
+			if !*useTLSFlag {
+				mb.TLS.Mode = mailwatcher.TLSPlaintext
+			}
+		}
+		if mb.TLS.MinVersion, err = mailwatcher.ParseTLSVersion(*tlsMinFlag); err != nil {
+			log.Fatalln(err)
+		}
+		for _, pin := range strings.Split(*tlsPinsFlag, ",") {
+			if strings.TrimSpace(pin) == "" {
+				continue
+			}
+			pin, err := mailwatcher.ParseTLSPin(pin)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			mb.TLS.Pins = append(mb.TLS.Pins, pin)
+		}
+		if err := mailwatcher.CheckTLS(&mb); err != nil {
+			log.Fatalln(err)
+		}
+		for _, folder := range strings.Split(*foldersFlag, ",") {
+			if folder = strings.TrimSpace(folder); folder != "" {
+				mb.Folders = append(mb.Folders, folder)
+			}
+		}
+		if *actionsFlag != "" {
+			actions, err := mailwatcher.ParsePostActions(strings.Split(*actionsFlag, ","))
+			if err != nil {
+				log.Fatalln(err)
+			}
+			mb.Actions = actions
 		}
 
+		if *oauthFlag != "" {
+			provider, ok := conf.OAuthProviders[*oauthFlag]
+			if !ok {
+				log.Fatalf("OAuth2 provider %s isn't in the config\n", *oauthFlag)
+			}
+			os.Exit(ctl.EnrollOAuth(&repo, &mb, provider, *oauthFlowFlag, os.Stdout))
+		}
 		os.Exit(ctl.AddEmail(&repo, &mb))
 	}
 
@@ -77,39 +142,40 @@ func main() {
 		os.Exit(ctl.RemoveEmail(&repo, *emailFlag))
 	}
 
-	// Just for test
-	c, err := net.Dial("unix", "/tmp/mailwatcher.sock")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	c, err := client.Dial(ctx, client.Options{})
+	cancel()
 	if err != nil {
 		log.Fatalln(err)
 	}
 	defer c.Close()
 
-	go controller.GetMsg(c)
-	var cmd mailwatcher.Action
-	switch *sendMsgFlag {
-	case "Watch":
-		cmd = mailwatcher.Watch
-	case "WatchAll":
-		cmd = mailwatcher.WatchAll
-	case "Stop":
-		cmd = mailwatcher.Stop
-	case "StopAll":
-		cmd = mailwatcher.StopAll
-	default:
-		cmd = mailwatcher.ConnectionError
+	if *statusFlag {
+		os.Exit(ctl.Status(c, *emailFlag))
 	}
 
-	msg := mailwatcher.Message{
-		Cmd: cmd,
-		Params: map[string]interface{}{
-			"email": *emailFlag,
-		},
+	if *sendMsgFlag != "" {
+		if code := ctl.SendCommand(c, *sendMsgFlag, *emailFlag); code != 0 {
+			os.Exit(code)
+		}
+
+		// Keep printing what the service sends until interrupted
+		go controller.PrintEvents(c)
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		os.Exit(0)
 	}
-	controller.SendMsg(c, &msg)
 
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-	<-stop
+	log.Fatalln("One of list, add, delete, status or msg must be specified")
+}
 
-	log.Fatalln("One of list, add or remove must be specified")
+// isFlagSet tells if the flag was given on the command line, rather than
+// left at its default
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
 }
@@ -1,12 +1,17 @@
 package controller
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"log"
+	"mailcode/service/client"
 	"mailcode/service/internal/mailwatcher"
+	"strings"
+	"time"
 )
 
+const requestTimeout = 10 * time.Second
+
 type WatcherCtl struct{}
 
 func (*WatcherCtl) ListEmails(repo *mailwatcher.Repository) int {
@@ -17,7 +22,7 @@ func (*WatcherCtl) ListEmails(repo *mailwatcher.Repository) int {
 	}
 
 	for mb := mbs.Front(); mb != nil; mb = mb.Next() {
-		fmt.Println(mb.Value.(mailwatcher.Mailbox).ToString())
+		fmt.Println(mb.Value.(*mailwatcher.Mailbox).ToString())
 	}
 
 	return 0
@@ -41,29 +46,119 @@ func (*WatcherCtl) RemoveEmail(repo *mailwatcher.Repository, email string) int {
 	return 0
 }
 
-func GetMsg(r io.Reader) {
-	buf := make([]byte, 1024)
-	for {
-		n, err := r.Read(buf[:])
-		if err != nil {
-			break
-		}
-		if n == 0 {
-			break
-		}
-		println("Client got:", string(buf[0:n]))
+func (*WatcherCtl) Status(c *client.Client, email string) int {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	mailboxes, err := c.Status(ctx, email)
+	if err != nil {
+		log.Println(err)
+		return 1
 	}
 
-	println("Done listening")
+	for _, mb := range mailboxes {
+		fmt.Println(formatStatus(&mb))
+	}
+	return 0
 }
 
-func SendMsg(w io.Writer, msg *mailwatcher.Message) {
-	m, err := mailwatcher.Serialize(msg)
-	if err != nil {
-		log.Fatalln(err)
+// SendCommand sends one of Watch, WatchAll, Stop or StopAll
+func (*WatcherCtl) SendCommand(c *client.Client, cmd string, email string) int {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	var err error
+	switch cmd {
+	case "Watch":
+		err = c.Watch(ctx, email)
+	case "WatchAll":
+		err = c.WatchAll(ctx)
+	case "Stop":
+		err = c.Stop(ctx, email)
+	case "StopAll":
+		err = c.StopAll(ctx)
+	default:
+		err = fmt.Errorf("unknown command '%s'", cmd)
 	}
-	_, err = w.Write(m)
+
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+func emailNotes(info *client.EmailInfo) string {
+	if !info.Stale {
+		return ""
+	}
+	if info.ReceivedAt != nil {
+		return fmt.Sprintf(" (stale, received %s)", info.ReceivedAt.Local().Format(time.DateTime))
+	}
+	return " (stale)"
+}
+
+// PrintEvents prints codes, links and mailbox state changes until the client
+// is closed
+func PrintEvents(c *client.Client) {
+	codes, links, states := c.Codes(), c.Links(), c.States()
+	for codes != nil || links != nil || states != nil {
+		select {
+		case code, ok := <-codes:
+			if !ok {
+				codes = nil
+				continue
+			}
+			notes := emailNotes(&code.EmailInfo)
+			if code.Confidence < 1 {
+				notes += fmt.Sprintf(" (guessed, %.0f%% sure)", code.Confidence*100)
+			}
+			fmt.Printf("code from %s in %s/%s: %s%s\n", code.Sender, code.Mailbox, code.Folder, code.Code, notes)
+		case link, ok := <-links:
+			if !ok {
+				links = nil
+				continue
+			}
+			fmt.Printf("link from %s in %s/%s: %s%s\n", link.Sender, link.Mailbox, link.Folder, link.URL, emailNotes(&link.EmailInfo))
+		case st, ok := <-states:
+			if !ok {
+				states = nil
+				continue
+			}
+			if st.Error != "" {
+				fmt.Printf("%s is %s: %s\n", st.Mailbox, st.State, st.Error)
+			} else if st.NextRetry != nil {
+				fmt.Printf("%s is %s at %s\n", st.Mailbox, st.State, st.NextRetry.Local().Format(time.TimeOnly))
+			} else {
+				fmt.Printf("%s is %s\n", st.Mailbox, st.State)
+			}
+		}
+	}
+}
+
+func formatStatus(st *client.MailboxStatus) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "email: %s\n", st.Email)
+	fmt.Fprintf(&b, "state: %s\n", st.State)
+	fmt.Fprintf(&b, "connected since: %s\n", formatTime(st.ConnectedSince))
+	fmt.Fprintf(&b, "last idle: %s\n", formatTime(st.LastIdle))
+	fmt.Fprintf(&b, "last fetch: %s\n", formatTime(st.LastFetch))
+	fmt.Fprintf(&b, "last code: %s\n", formatTime(st.LastCode))
+	if st.LastError != "" {
+		fmt.Fprintf(&b, "last error: %s (%s)\n", st.LastError, formatTime(st.LastErrorAt))
+	} else {
+		fmt.Fprintf(&b, "last error: -\n")
+	}
+	fmt.Fprintf(&b, "reconnects: %d\n", st.Reconnects)
+	if st.NextRetry != nil {
+		fmt.Fprintf(&b, "next retry: %s\n", st.NextRetry.Local().Format(time.DateTime))
+	}
+	return b.String()
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
 	}
+	return fmt.Sprintf("%s (%s ago)", t.Local().Format(time.DateTime), time.Since(*t).Round(time.Second))
 }
@@ -0,0 +1,142 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mailcode/service/internal/mailwatcher"
+	"net"
+	"net/http"
+	"time"
+)
+
+// How long the user has to sign in
+const enrollTimeout = 10 * time.Minute
+
+// EnrollOAuth signs the user in with the provider and adds the mailbox with
+// the refresh token it got. The flow is "code" for the authorization code
+// flow with a loopback redirect, or "device" for the device code flow.
+func (*WatcherCtl) EnrollOAuth(repo *mailwatcher.Repository, mb *mailwatcher.Mailbox, p *mailwatcher.OAuthProvider, flow string, out io.Writer) int {
+	ctx, cancel := context.WithTimeout(context.Background(), enrollTimeout)
+	defer cancel()
+
+	var token mailwatcher.OAuthToken
+	var err error
+	switch flow {
+	case "code":
+		token, err = AuthorizeWithCode(ctx, p, out)
+	case "device":
+		token, err = AuthorizeDevice(ctx, p, out)
+	default:
+		err = fmt.Errorf("unknown oauth2 flow '%s', must be code or device", flow)
+	}
+	if err == nil && token.RefreshToken == "" {
+		err = fmt.Errorf("oauth2 provider %s didn't issue a refresh token, check its scopes and auth_params", p.Name)
+	}
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	mb.OAuthProvider = p.Name
+	mb.RefreshToken = token.RefreshToken
+	mb.Password = ""
+	if err := repo.AddMailbox(mb); err != nil {
+		log.Println(err)
+		return 1
+	}
+	fmt.Fprintf(out, "Added %s, signed in with %s\n", mb.Email, p.Name)
+	return 0
+}
+
+// AuthorizeWithCode prints the URL to sign in at and waits for the provider
+// to redirect the browser back to a listener on the loopback interface
+func AuthorizeWithCode(ctx context.Context, p *mailwatcher.OAuthProvider, out io.Writer) (mailwatcher.OAuthToken, error) {
+	if p.AuthURL == "" {
+		return mailwatcher.OAuthToken{}, fmt.Errorf("oauth2 provider %s has no auth_url", p.Name)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return mailwatcher.OAuthToken{}, err
+	}
+	redirectURI := fmt.Sprintf("http://%s/", listener.Addr().String())
+
+	verifier, challenge, err := mailwatcher.NewPKCE()
+	if err != nil {
+		listener.Close()
+		return mailwatcher.OAuthToken{}, err
+	}
+	state, err := mailwatcher.NewOAuthState()
+	if err != nil {
+		listener.Close()
+		return mailwatcher.OAuthToken{}, err
+	}
+
+	type result struct {
+		code string
+		err  error
+	}
+	results := make(chan result, 1)
+	srv := &http.Server{
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			// Browsers also ask for favicons and the like
+			if q.Get("state") == "" && q.Get("error") == "" {
+				http.NotFound(w, r)
+				return
+			}
+
+			res := result{code: q.Get("code")}
+			switch {
+			case q.Get("state") != state:
+				res.err = errors.New("oauth2: redirect with the wrong state")
+			case q.Get("error") != "":
+				res.err = &mailwatcher.OAuthError{Code: q.Get("error"), Description: q.Get("error_description")}
+			case res.code == "":
+				res.err = errors.New("oauth2: redirect without a code")
+			}
+			if res.err != nil {
+				http.Error(w, res.err.Error(), http.StatusBadRequest)
+			} else {
+				fmt.Fprintln(w, "Signed in, you can close this window.")
+			}
+
+			select {
+			case results <- res:
+			default:
+			}
+		}),
+	}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	fmt.Fprintf(out, "Open this URL to sign in:\n\n%s\n\n", mailwatcher.OAuthAuthURL(p, redirectURI, state, challenge))
+
+	select {
+	case <-ctx.Done():
+		return mailwatcher.OAuthToken{}, ctx.Err()
+	case res := <-results:
+		if res.err != nil {
+			return mailwatcher.OAuthToken{}, res.err
+		}
+		return mailwatcher.ExchangeOAuthCode(ctx, p, res.code, redirectURI, verifier)
+	}
+}
+
+// AuthorizeDevice prints the code to enter at the provider and waits for the
+// user to do so
+func AuthorizeDevice(ctx context.Context, p *mailwatcher.OAuthProvider, out io.Writer) (mailwatcher.OAuthToken, error) {
+	auth, err := mailwatcher.StartDeviceAuthorization(ctx, p)
+	if err != nil {
+		return mailwatcher.OAuthToken{}, err
+	}
+
+	fmt.Fprintf(out, "Open %s and enter the code %s\n", auth.VerificationURI, auth.UserCode)
+	if auth.VerificationURIComplete != "" {
+		fmt.Fprintf(out, "or open %s\n", auth.VerificationURIComplete)
+	}
+	return mailwatcher.PollDeviceToken(ctx, p, &auth)
+}
@@ -0,0 +1,182 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"mailcode/service/internal/mailwatcher"
+)
+
+var authURLPattern = regexp.MustCompile(`http://\S+/auth\?\S+`)
+
+// syncBuffer is written by the flow while the fake browser reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// newCodeProvider serves a token endpoint that only exchanges the-code, and
+// only with the verifier of the challenge the auth URL was opened with
+func newCodeProvider(t *testing.T, challenge func() string) *mailwatcher.OAuthProvider {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if r.Form.Get("grant_type") != "authorization_code" || r.Form.Get("code") != "the-code" ||
+			base64.RawURLEncoding.EncodeToString(sum[:]) != challenge() {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"access","refresh_token":"refresh","expires_in":3600}`)
+	}))
+	t.Cleanup(srv.Close)
+
+	return &mailwatcher.OAuthProvider{
+		Name:     "test",
+		ClientID: "client",
+		AuthURL:  srv.URL + "/auth",
+		TokenURL: srv.URL,
+		Scopes:   []string{"mail"},
+	}
+}
+
+// openAuthURL waits for the flow to print its URL, like a user would
+func openAuthURL(t *testing.T, out *syncBuffer) url.Values {
+	deadline := time.Now().Add(5 * time.Second)
+	for !authURLPattern.MatchString(out.String()) {
+		if time.Now().After(deadline) {
+			t.Error("the auth URL was never printed")
+			return url.Values{}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	u, err := url.Parse(authURLPattern.FindString(out.String()))
+	if err != nil {
+		t.Error(err)
+		return url.Values{}
+	}
+	return u.Query()
+}
+
+func redirect(t *testing.T, redirectURI string, query string) int {
+	resp, err := http.Get(redirectURI + query)
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAuthorizeWithCode(t *testing.T) {
+	var mu sync.Mutex
+	challenge := ""
+	p := newCodeProvider(t, func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return challenge
+	})
+
+	out := &syncBuffer{}
+	statuses := make(chan []int, 1)
+	go func() {
+		q := openAuthURL(t, out)
+		mu.Lock()
+		challenge = q.Get("code_challenge")
+		mu.Unlock()
+		// Browsers also ask for a favicon, which mustn't end the flow
+		favicon := redirect(t, q.Get("redirect_uri"), "favicon.ico")
+		signedIn := redirect(t, q.Get("redirect_uri"), "?code=the-code&state="+url.QueryEscape(q.Get("state")))
+		statuses <- []int{favicon, signedIn}
+	}()
+
+	token, err := AuthorizeWithCode(context.Background(), p, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.RefreshToken != "refresh" {
+		t.Errorf("got refresh token %q, want refresh", token.RefreshToken)
+	}
+	if s := <-statuses; s[0] != http.StatusNotFound || s[1] != http.StatusOK {
+		t.Errorf("browser got %v, want 404 for the favicon and 200 for the redirect", s)
+	}
+}
+
+func TestAuthorizeWithCodeRejectsWrongState(t *testing.T) {
+	p := newCodeProvider(t, func() string { return "" })
+
+	out := &syncBuffer{}
+	status := make(chan int, 1)
+	go func() {
+		q := openAuthURL(t, out)
+		status <- redirect(t, q.Get("redirect_uri"), "?code=the-code&state=forged")
+	}()
+
+	if _, err := AuthorizeWithCode(context.Background(), p, out); err == nil {
+		t.Error("a redirect with the wrong state was accepted")
+	}
+	if s := <-status; s != http.StatusBadRequest {
+		t.Errorf("browser got %d, want 400", s)
+	}
+}
+
+func TestEnrollOAuthAddsMailbox(t *testing.T) {
+	var mu sync.Mutex
+	challenge := ""
+	p := newCodeProvider(t, func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return challenge
+	})
+	repo, err := mailwatcher.OpenRepository(filepath.Join(t.TempDir(), "emails.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	out := &syncBuffer{}
+	go func() {
+		q := openAuthURL(t, out)
+		mu.Lock()
+		challenge = q.Get("code_challenge")
+		mu.Unlock()
+		redirect(t, q.Get("redirect_uri"), "?code=the-code&state="+url.QueryEscape(q.Get("state")))
+	}()
+
+	mb := &mailwatcher.Mailbox{Email: "user@example.com", Password: "unused", Server: "imap.example.com", Port: 993}
+	if rc := (&WatcherCtl{}).EnrollOAuth(&repo, mb, p, "code", out); rc != 0 {
+		t.Fatalf("EnrollOAuth returned %d", rc)
+	}
+
+	stored, err := repo.GetMailbox("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.OAuthProvider != "test" || stored.RefreshToken != "refresh" || stored.Password != "" {
+		t.Errorf("stored provider %q, refresh token %q and password %q", stored.OAuthProvider, stored.RefreshToken, stored.Password)
+	}
+}
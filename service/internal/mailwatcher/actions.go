@@ -0,0 +1,262 @@
+package mailwatcher
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// What is done to an email once a code was extracted from it. Actions are
+// written as "none", "seen", "keyword:<keyword>", "move:<folder>" and
+// "delete" or "delete:<delay>".
+type PostAction struct {
+	Kind    PostActionKind
+	Keyword string
+	Folder  string
+	Delay   time.Duration
+}
+
+type PostActionKind int32
+
+const (
+	LeaveUntouched PostActionKind = 0
+	MarkSeen       PostActionKind = 1
+	AddKeyword     PostActionKind = 2
+	MoveToFolder   PostActionKind = 3
+	DeleteEmail    PostActionKind = 4
+)
+
+// Returned once emails were marked deleted on a server that can't expunge
+// them alone. A plain EXPUNGE would also remove emails someone else marked
+// deleted, so they are left for the user's client to expunge.
+var errExpungeSkipped = errors.New("the server doesn't support UIDPLUS, the emails were only marked deleted")
+
+func ParsePostAction(spec string) (PostAction, error) {
+	name, arg, hasArg := strings.Cut(strings.TrimSpace(spec), ":")
+	switch strings.ToLower(name) {
+	case "none":
+		if hasArg {
+			return PostAction{}, errors.New("none takes no argument")
+		}
+		return PostAction{Kind: LeaveUntouched}, nil
+	case "seen":
+		if hasArg {
+			return PostAction{}, errors.New("seen takes no argument")
+		}
+		return PostAction{Kind: MarkSeen}, nil
+	case "keyword":
+		if arg == "" || strings.HasPrefix(arg, "\\") || strings.ContainsAny(arg, " (){%*\"\\]\r\n") {
+			return PostAction{}, fmt.Errorf("invalid keyword '%s'", arg)
+		}
+		return PostAction{Kind: AddKeyword, Keyword: arg}, nil
+	case "move":
+		if strings.TrimSpace(arg) == "" || strings.ContainsAny(arg, "\r\n") {
+			return PostAction{}, errors.New("move needs a folder")
+		}
+		return PostAction{Kind: MoveToFolder, Folder: arg}, nil
+	case "delete":
+		action := PostAction{Kind: DeleteEmail}
+		if hasArg {
+			delay, err := time.ParseDuration(arg)
+			if err != nil || delay < 0 {
+				return PostAction{}, fmt.Errorf("invalid delete delay '%s'", arg)
+			}
+			action.Delay = delay
+		}
+		return action, nil
+	default:
+		return PostAction{}, fmt.Errorf("unknown action '%s'", name)
+	}
+}
+
+func (a PostAction) ToString() string {
+	switch a.Kind {
+	case MarkSeen:
+		return "seen"
+	case AddKeyword:
+		return "keyword:" + a.Keyword
+	case MoveToFolder:
+		return "move:" + a.Folder
+	case DeleteEmail:
+		if a.Delay > 0 {
+			return "delete:" + a.Delay.String()
+		}
+		return "delete"
+	default:
+		return "none"
+	}
+}
+
+// ParsePostActions parses and checks a whole list. Moving and deleting take
+// the email out of the folder, so only one of them is allowed and only last.
+func ParsePostActions(specs []string) ([]PostAction, error) {
+	actions := []PostAction{}
+	for i, spec := range specs {
+		action, err := ParsePostAction(spec)
+		if err != nil {
+			return nil, err
+		}
+		if (action.Kind == MoveToFolder || action.Kind == DeleteEmail) && i != len(specs)-1 {
+			return nil, fmt.Errorf("%s must be the last action", action.ToString())
+		}
+		if action.Kind != LeaveUntouched {
+			actions = append(actions, action)
+		}
+	}
+	return actions, nil
+}
+
+func postActionStrings(actions []PostAction) []string {
+	specs := []string{}
+	for _, action := range actions {
+		specs = append(specs, action.ToString())
+	}
+	return specs
+}
+
+// applyPostActions runs the mailbox's actions on the emails of the selected
+// folder that codes were extracted from. Deletions are only scheduled here.
+func applyPostActions(ctx *MailboxContext, c *client.Client, progress *FolderProgress, uids *imap.SeqSet) error {
+	if uids.Empty() {
+		return nil
+	}
+
+	for _, action := range ctx.mailbox.Actions {
+		var err error
+		switch action.Kind {
+		case MarkSeen:
+			err = addFlags(c, uids, imap.SeenFlag)
+		case AddKeyword:
+			err = addFlags(c, uids, action.Keyword)
+		case MoveToFolder:
+			if err = createFolder(c, action.Folder); err == nil {
+				err = moveEmails(c, uids, action.Folder)
+			}
+		case DeleteEmail:
+			err = ctx.scheduleDeletion(progress, uids, time.Now().Add(action.Delay))
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", action.ToString(), err)
+		}
+	}
+	return nil
+}
+
+func moveEmails(c *client.Client, uids *imap.SeqSet, folder string) error {
+	if move, err := c.Support("MOVE"); err != nil {
+		return err
+	} else if move {
+		return c.UidMove(uids, folder)
+	}
+	// go-imap's own fallback expunges every deleted email of the folder
+	if err := c.UidCopy(uids, folder); err != nil {
+		return err
+	}
+	return expungeEmails(c, uids)
+}
+
+func addFlags(c *client.Client, uids *imap.SeqSet, flag string) error {
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	return c.UidStore(uids, item, []interface{}{flag}, nil)
+}
+
+// createFolder creates the folder unless it already exists. The name is a
+// LIST pattern too, so % and * in it may match other folders.
+func createFolder(c *client.Client, folder string) error {
+	infos := make(chan *imap.MailboxInfo, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", folder, infos)
+	}()
+
+	exists := false
+	for info := range infos {
+		exists = exists || info.Name == folder
+	}
+	if err := <-done; err != nil || exists {
+		return err
+	}
+
+	log.Printf("Creating folder %s\n", folder)
+	return c.Create(folder)
+}
+
+// scheduleDeletion stores the deletions, so that they survive restarts
+func (ctx *MailboxContext) scheduleDeletion(progress *FolderProgress, uids *imap.SeqSet, due time.Time) error {
+	deletions := []PendingDeletion{}
+	for _, seq := range uids.Set {
+		for uid := seq.Start; uid <= seq.Stop; uid++ {
+			deletions = append(deletions, PendingDeletion{
+				Email:       progress.Email,
+				Folder:      progress.Folder,
+				UidValidity: progress.UidValidity,
+				Uid:         uid,
+				Due:         due,
+			})
+		}
+	}
+	return ctx.repo.AddPendingDeletions(deletions)
+}
+
+// deleteDueEmails deletes and expunges the folder's emails whose delay is
+// over. It returns when the next one is due, or zero if there is none.
+func deleteDueEmails(ctx *MailboxContext, c *client.Client, progress *FolderProgress) (time.Time, error) {
+	deletions, err := ctx.repo.GetPendingDeletions(progress.Email, progress.Folder)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	now := time.Now()
+	uids := new(imap.SeqSet)
+	due := 0
+	for ; due < len(deletions) && !deletions[due].Due.After(now); due++ {
+		uids.AddNum(deletions[due].Uid)
+	}
+	next := time.Time{}
+	if due < len(deletions) {
+		next = deletions[due].Due
+	}
+	if uids.Empty() {
+		return next, nil
+	}
+
+	err = expungeEmails(c, uids)
+	if errors.Is(err, errExpungeSkipped) {
+		// Retrying won't help, the emails stay marked deleted
+		ctx.fail(fmt.Errorf("%s: delete: %w", progress.Folder, err))
+	} else if err != nil {
+		// Kept, so that they are retried once the session is back
+		return time.Time{}, fmt.Errorf("delete: %w", err)
+	}
+	return next, ctx.repo.RemovePendingDeletions(deletions[:due])
+}
+
+// timerUntil fires at t, or never if t is zero
+func timerUntil(t time.Time) <-chan time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return time.After(time.Until(t))
+}
+
+func expungeEmails(c *client.Client, uids *imap.SeqSet) error {
+	if err := addFlags(c, uids, imap.DeletedFlag); err != nil {
+		return err
+	}
+	if uidPlus, err := c.Support("UIDPLUS"); err != nil {
+		return err
+	} else if uidPlus {
+		cmd := &imap.Command{Name: "UID", Arguments: []interface{}{imap.RawString("EXPUNGE"), uids}}
+		status, err := c.Execute(cmd, nil)
+		if err != nil {
+			return err
+		}
+		return status.Err()
+	}
+	return errExpungeSkipped
+}
@@ -0,0 +1,81 @@
+package mailwatcher
+
+import (
+	"io"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/charset"
+)
+
+// Both libraries only decode UTF-8 and US-ASCII by themselves. Importing the
+// charset package sets go-message's, go-imap needs it for envelope subjects.
+func init() {
+	imap.CharsetReader = charset.Reader
+}
+
+// The readable parts of an email, with transfer encodings and charsets
+// decoded and line breaks normalized to \n. Multiple parts of the same type
+// are joined. The header is the email's top-level one.
+type emailBody struct {
+	Header message.Header
+	Text   string
+	HTML   string
+}
+
+// decodeBody walks the MIME structure of a whole email, headers included.
+// Parts in an unknown charset or transfer encoding are used as they are.
+func decodeBody(r io.Reader) (emailBody, error) {
+	body := emailBody{}
+	e, err := message.Read(r)
+	if err != nil && !isUnknownMime(err) {
+		return body, err
+	}
+	body.Header = e.Header
+
+	text, html := []string{}, []string{}
+	err = e.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil && !isUnknownMime(err) {
+			return err
+		}
+		if part.MultipartReader() != nil {
+			return nil
+		}
+		if disp, _, _ := part.Header.ContentDisposition(); disp == "attachment" {
+			return nil
+		}
+
+		mediaType, _, _ := part.Header.ContentType()
+		if mediaType == "" {
+			mediaType = "text/plain"
+		}
+		if mediaType != "text/plain" && mediaType != "text/html" {
+			return nil
+		}
+		content, err := io.ReadAll(part.Body)
+		if err != nil {
+			return err
+		}
+		s := normalizeLineBreaks(string(content))
+		if mediaType == "text/plain" {
+			text = append(text, s)
+		} else {
+			html = append(html, s)
+		}
+		return nil
+	})
+
+	body.Text = strings.Join(text, "\n")
+	body.HTML = strings.Join(html, "\n")
+	return body, err
+}
+
+func isUnknownMime(err error) bool {
+	return message.IsUnknownCharset(err) || message.IsUnknownEncoding(err)
+}
+
+func normalizeLineBreaks(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.ReplaceAll(s, "\r", "\n")
+}
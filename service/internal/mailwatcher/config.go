@@ -1,24 +1,250 @@
 package mailwatcher
 
 import (
+	"cmp"
 	"errors"
+	"fmt"
 	"log"
 	"os"
 	"path"
 	"regexp"
+	"slices"
+	"strings"
+	"time"
 
+	"golang.org/x/text/unicode/norm"
 	"gopkg.in/yaml.v3"
 )
 
 type Extractor struct {
 	Reg     regexp.Regexp
 	Capture interface{}
+	Target  ExtractorTarget
+	// Name of the header for TargetHeader
+	Header string
+	// Emails the extractor is tried on
+	Match ExtractorMatch
+	// Extractors with a higher priority are tried first
+	Priority int
+	// Set for extractors that look for verification links instead of codes
+	Link *LinkPattern
+}
+
+// Verification links are recognized by their host, a glob like the sender
+// patterns of ExtractorMatch, and optionally a regex on their path.
+type LinkPattern struct {
+	Host string
+	Path *regexp.Regexp
+}
+
+// Conditions an email has to meet for an extractor to be tried on it. Sender
+// and recipient patterns are globs on the address, or on the domain if they
+// have no @. A domain also matches its subdomains.
+type ExtractorMatch struct {
+	Senders    []string
+	Recipients []string
+	Subject    *regexp.Regexp
+}
+
+// What an extractor is matched against. The text is the email's text part,
+// or its HTML part rendered as text if it has none.
+type ExtractorTarget int32
+
+const (
+	// The text first, then the raw HTML
+	TargetBody    ExtractorTarget = 0
+	TargetText    ExtractorTarget = 1
+	TargetHTML    ExtractorTarget = 2
+	TargetSubject ExtractorTarget = 3
+	TargetHeader  ExtractorTarget = 4
+)
+
+// parseExtractorTarget parses "text", "html", "both", "subject" and
+// "header:<name>" and returns the header's name for the latter.
+func parseExtractorTarget(target string) (ExtractorTarget, string, error) {
+	name, header, _ := strings.Cut(target, ":")
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "both":
+		return TargetBody, "", nil
+	case "text":
+		return TargetText, "", nil
+	case "html":
+		return TargetHTML, "", nil
+	case "subject":
+		return TargetSubject, "", nil
+	case "header":
+		header = strings.TrimSpace(header)
+		if header == "" || strings.ContainsAny(header, " :()\r\n") {
+			return TargetBody, "", fmt.Errorf("invalid header name in extractor target '%s'", target)
+		}
+		return TargetHeader, header, nil
+	default:
+		return TargetBody, "", fmt.Errorf("unknown extractor target '%s', must be text, html, both, subject or header:<name>", target)
+	}
+}
+
+func parseExtractorMatch(senders []string, recipients []string, subject string) (ExtractorMatch, error) {
+	match := ExtractorMatch{}
+	for _, pattern := range append(append([]string{}, senders...), recipients...) {
+		if _, err := path.Match(pattern, ""); err != nil || strings.TrimSpace(pattern) == "" {
+			return match, fmt.Errorf("invalid address pattern '%s' in extractor match", pattern)
+		}
+	}
+	match.Senders = senders
+	match.Recipients = recipients
+	if subject != "" {
+		reg, err := regexp.Compile(subject)
+		if err != nil {
+			return match, fmt.Errorf("invalid subject pattern '%s' in extractor match: %w", subject, err)
+		}
+		match.Subject = reg
+	}
+	return match, nil
+}
+
+func parseLinkPattern(host string, linkPath string) (LinkPattern, error) {
+	link := LinkPattern{Host: strings.ToLower(strings.TrimSpace(host))}
+	if _, err := path.Match(link.Host, ""); err != nil || link.Host == "" || strings.ContainsAny(link.Host, "/@") {
+		return link, fmt.Errorf("invalid link host '%s'", host)
+	}
+	if linkPath != "" {
+		reg, err := regexp.Compile(linkPath)
+		if err != nil {
+			return link, fmt.Errorf("invalid link path '%s': %w", linkPath, err)
+		}
+		link.Path = reg
+	}
+	return link, nil
+}
+
+// parseLocalFilter compiles the subjects as case insensitive regexes. Like
+// the subjects they are matched against, they are normalized to NFKC.
+func parseLocalFilter(subjects []string, senders []string, headers map[string]string) (LocalFilter, error) {
+	filter := LocalFilter{}
+	for _, subject := range subjects {
+		reg, err := regexp.Compile("(?i)" + norm.NFKC.String(subject))
+		if err != nil {
+			return filter, fmt.Errorf("invalid subject pattern '%s': %w", subject, err)
+		}
+		filter.Subjects = append(filter.Subjects, reg)
+	}
+	for _, pattern := range senders {
+		if _, err := path.Match(pattern, ""); err != nil || strings.TrimSpace(pattern) == "" {
+			return filter, fmt.Errorf("invalid sender pattern '%s' in matching", pattern)
+		}
+	}
+	filter.Senders = senders
+	// Map order is random, the filters are sorted for stable fetches
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if strings.TrimSpace(name) == "" || strings.ContainsAny(name, " :()\r\n") {
+			return filter, fmt.Errorf("invalid header name '%s' in matching", name)
+		}
+		reg, err := regexp.Compile("(?i)" + norm.NFKC.String(headers[name]))
+		if err != nil {
+			return filter, fmt.Errorf("invalid pattern '%s' for header %s: %w", headers[name], name, err)
+		}
+		filter.Headers = append(filter.Headers, HeaderFilter{Name: name, Value: reg})
+	}
+	return filter, nil
+}
+
+func (m *ExtractorMatch) isEmpty() bool {
+	return len(m.Senders) == 0 && len(m.Recipients) == 0 && m.Subject == nil
+}
+
+func (t ExtractorTarget) matchesText() bool {
+	return t == TargetBody || t == TargetText
+}
+
+func (t ExtractorTarget) matchesHTML() bool {
+	return t == TargetBody || t == TargetHTML
+}
+
+func (t ExtractorTarget) needsBody() bool {
+	return t == TargetBody || t == TargetText || t == TargetHTML
+}
+
+// Decides which emails are worth extracting codes from by itself, instead of
+// leaving it to the server's SEARCH. Any of the subjects, senders or headers
+// has to match, an empty filter matches every email.
+type LocalFilter struct {
+	Subjects []*regexp.Regexp
+	// Globs like the sender patterns of ExtractorMatch
+	Senders []string
+	Headers []HeaderFilter
+}
+
+type HeaderFilter struct {
+	Name  string
+	Value *regexp.Regexp
 }
 
 type Configuration struct {
 	DatabasePath string
 	Subjects     []string
-	Extractors   []Extractor
+	// Set if subjects are matched locally
+	LocalFilter *LocalFilter
+	Extractors  []Extractor
+	// How long extracted codes are kept for clients that connect late
+	RecentCodesTTL  time.Duration
+	RecentCodesSize int
+	// Bounds of the delay between reconnect attempts
+	MinReconnectDelay time.Duration
+	MaxReconnectDelay time.Duration
+	// How often mailboxes without IDLE are checked for new emails
+	PollInterval time.Duration
+	// How long to stay in IDLE before leaving it to probe the connection
+	KeepaliveInterval time.Duration
+	// How long to wait for the server to answer a command
+	CommandTimeout time.Duration
+	// Guess codes in emails none of the extractors matched
+	Heuristic bool
+	// Guesses scoring lower are dropped
+	HeuristicMinConfidence float64
+	// How long and how many sent codes are remembered, so that they aren't
+	// sent again, and if they are kept in the database across restarts
+	DedupTTL     time.Duration
+	DedupSize    int
+	DedupPersist bool
+	// Codes from emails received longer ago are stale. Zero disables it.
+	MaxCodeAge time.Duration
+	// Stale codes aren't sent at all, instead of being flagged
+	SuppressStale bool
+	// OAuth2 providers by name, for mailboxes that don't sign in with a
+	// password
+	OAuthProviders map[string]*OAuthProvider
+}
+
+const (
+	defaultRecentCodesTTL  = 5 * time.Minute
+	defaultRecentCodesSize = 32
+	defaultPollInterval    = time.Minute
+	// Plenty of NAT gateways drop connections idle for more than 5 minutes
+	defaultKeepaliveInterval = 5 * time.Minute
+	defaultCommandTimeout    = time.Minute
+	// RFC 2177 lets servers log out clients that IDLE for more than 30 minutes
+	maxKeepaliveInterval = 29 * time.Minute
+	defaultMinConfidence = 0.5
+	defaultDedupTTL      = 24 * time.Hour
+	defaultDedupSize     = 1024
+)
+
+// isStale judges a code by when the server received the email, or by its
+// Date header if the server didn't say
+func isStale(config *Configuration, code *EmailCode) bool {
+	received := code.ReceivedAt
+	if received.IsZero() {
+		received = code.Date
+	}
+	if config.MaxCodeAge == 0 || received.IsZero() {
+		return false
+	}
+	return code.ExtractedAt.Sub(received) > config.MaxCodeAge
 }
 
 func DefaultConfigFile() string {
@@ -45,9 +271,61 @@ func LoadConfig(configFile string) (Configuration, error) {
 		Db   string   `yaml:"database,omitempty"`
 		Subs []string `yaml:"subjects"`
 		Extr []struct {
-			Reg string      `yaml:"regex"`
-			Cap interface{} `yaml:"capture"`
+			Reg    string      `yaml:"regex"`
+			Cap    interface{} `yaml:"capture"`
+			Target string      `yaml:"target"`
+			Match  struct {
+				From    []string `yaml:"from"`
+				To      []string `yaml:"to"`
+				Subject string   `yaml:"subject"`
+			} `yaml:"match"`
+			Priority int `yaml:"priority"`
+			Link     *struct {
+				Host string `yaml:"host"`
+				Path string `yaml:"path"`
+			} `yaml:"link"`
 		} `yaml:"extractors"`
+		RecentCodes struct {
+			TTL  *time.Duration `yaml:"ttl"`
+			Size *int           `yaml:"size"`
+		} `yaml:"recent_codes"`
+		Reconnect struct {
+			MinDelay time.Duration `yaml:"min_delay"`
+			MaxDelay time.Duration `yaml:"max_delay"`
+		} `yaml:"reconnect"`
+		PollInterval time.Duration `yaml:"poll_interval"`
+		Keepalive    struct {
+			Interval time.Duration `yaml:"interval"`
+			Timeout  time.Duration `yaml:"timeout"`
+		} `yaml:"keepalive"`
+		Matching struct {
+			Mode    string            `yaml:"mode"`
+			Senders []string          `yaml:"senders"`
+			Headers map[string]string `yaml:"headers"`
+		} `yaml:"matching"`
+		Heuristic struct {
+			Enabled       bool     `yaml:"enabled"`
+			MinConfidence *float64 `yaml:"min_confidence"`
+		} `yaml:"heuristic"`
+		MaxAge struct {
+			Age   time.Duration `yaml:"age"`
+			Stale string        `yaml:"stale"`
+		} `yaml:"max_age"`
+		Dedup struct {
+			TTL     *time.Duration `yaml:"ttl"`
+			Size    *int           `yaml:"size"`
+			Persist bool           `yaml:"persist"`
+		} `yaml:"dedup"`
+		OAuth2 map[string]struct {
+			ClientID     string            `yaml:"client_id"`
+			ClientSecret string            `yaml:"client_secret"`
+			AuthURL      string            `yaml:"auth_url"`
+			DeviceURL    string            `yaml:"device_url"`
+			TokenURL     string            `yaml:"token_url"`
+			Scopes       []string          `yaml:"scopes"`
+			AuthParams   map[string]string `yaml:"auth_params"`
+			Mechanism    string            `yaml:"mechanism"`
+		} `yaml:"oauth2"`
 	}{}
 	err = yaml.Unmarshal(bytes, &config)
 
@@ -57,24 +335,156 @@ func LoadConfig(configFile string) (Configuration, error) {
 
 	regs := []Extractor{}
 	for _, reg := range config.Extr {
-		pReg, err := regexp.Compile(reg.Reg)
+		extractor := Extractor{}
+		if reg.Link != nil {
+			link, err := parseLinkPattern(reg.Link.Host, reg.Link.Path)
+			if err != nil {
+				return conf, err
+			}
+			extractor.Link = &link
+		} else {
+			pReg, err := regexp.Compile(reg.Reg)
+			if err != nil {
+				log.Fatalf("Invalid extraction regex: %s\n", reg.Reg)
+			}
+			_, isString := reg.Cap.(string)
+			_, isInt := reg.Cap.(int)
+			if !isString && !isInt {
+				log.Fatalln("Extraction capture must be either an index (positive int) or a name (string)")
+			}
+			extractor.Reg = *pReg
+			extractor.Capture = reg.Cap
+		}
+		target, header, err := parseExtractorTarget(reg.Target)
 		if err != nil {
-			log.Fatalf("Invalid extraction regex: %s\n", reg.Reg)
+			return conf, err
 		}
-		_, isString := reg.Cap.(string)
-		_, isInt := reg.Cap.(int)
-		if !isString && !isInt {
-			log.Fatalln("Extraction capture must be either an index (positive int) or a name (string)")
+
+		match, err := parseExtractorMatch(reg.Match.From, reg.Match.To, reg.Match.Subject)
+		if err != nil {
+			return conf, err
 		}
 
-		regs = append(regs, Extractor{
-			Reg:     *pReg,
-			Capture: reg.Cap,
-		})
+		extractor.Target = target
+		extractor.Header = header
+		extractor.Match = match
+		extractor.Priority = reg.Priority
+		regs = append(regs, extractor)
 	}
+	// Extractors of the same priority keep their order
+	slices.SortStableFunc(regs, func(a, b Extractor) int {
+		return cmp.Compare(b.Priority, a.Priority)
+	})
 	conf.Extractors = regs
 	conf.Subjects = config.Subs
+	switch config.Matching.Mode {
+	case "", "server":
+		if len(config.Matching.Senders) > 0 || len(config.Matching.Headers) > 0 {
+			return conf, errors.New("matching senders and headers need the local matching mode")
+		}
+	case "local":
+		filter, err := parseLocalFilter(config.Subs, config.Matching.Senders, config.Matching.Headers)
+		if err != nil {
+			return conf, err
+		}
+		conf.LocalFilter = &filter
+	default:
+		return conf, fmt.Errorf("unknown matching mode '%s', must be server or local", config.Matching.Mode)
+	}
 	conf.DatabasePath = config.Db
 
+	conf.RecentCodesTTL = defaultRecentCodesTTL
+	if config.RecentCodes.TTL != nil {
+		conf.RecentCodesTTL = *config.RecentCodes.TTL
+	}
+	conf.RecentCodesSize = defaultRecentCodesSize
+	if config.RecentCodes.Size != nil {
+		conf.RecentCodesSize = *config.RecentCodes.Size
+	}
+	if conf.RecentCodesTTL < 0 || conf.RecentCodesSize < 0 {
+		return conf, errors.New("recent_codes ttl and size must not be negative")
+	}
+
+	conf.MinReconnectDelay = defaultMinReconnectDelay
+	if config.Reconnect.MinDelay > 0 {
+		conf.MinReconnectDelay = config.Reconnect.MinDelay
+	}
+	conf.MaxReconnectDelay = defaultMaxReconnectDelay
+	if config.Reconnect.MaxDelay > 0 {
+		conf.MaxReconnectDelay = config.Reconnect.MaxDelay
+	}
+	if conf.MaxReconnectDelay < conf.MinReconnectDelay {
+		return conf, errors.New("reconnect max_delay must not be shorter than min_delay")
+	}
+
+	conf.PollInterval = defaultPollInterval
+	if config.PollInterval > 0 {
+		conf.PollInterval = config.PollInterval
+	}
+
+	conf.KeepaliveInterval = defaultKeepaliveInterval
+	if config.Keepalive.Interval > 0 {
+		conf.KeepaliveInterval = config.Keepalive.Interval
+	}
+	if conf.KeepaliveInterval > maxKeepaliveInterval {
+		return conf, errors.New("keepalive interval must not be longer than 29m")
+	}
+	conf.CommandTimeout = defaultCommandTimeout
+	if config.Keepalive.Timeout > 0 {
+		conf.CommandTimeout = config.Keepalive.Timeout
+	}
+
+	conf.Heuristic = config.Heuristic.Enabled
+	conf.HeuristicMinConfidence = defaultMinConfidence
+	if config.Heuristic.MinConfidence != nil {
+		conf.HeuristicMinConfidence = *config.Heuristic.MinConfidence
+	}
+	if conf.HeuristicMinConfidence < 0 || conf.HeuristicMinConfidence > 1 {
+		return conf, errors.New("heuristic min_confidence must be between 0 and 1")
+	}
+
+	conf.DedupTTL = defaultDedupTTL
+	if config.Dedup.TTL != nil {
+		conf.DedupTTL = *config.Dedup.TTL
+	}
+	conf.DedupSize = defaultDedupSize
+	if config.Dedup.Size != nil {
+		conf.DedupSize = *config.Dedup.Size
+	}
+	if conf.DedupTTL < 0 || conf.DedupSize < 0 {
+		return conf, errors.New("dedup ttl and size must not be negative")
+	}
+	conf.DedupPersist = config.Dedup.Persist
+
+	if config.MaxAge.Age < 0 {
+		return conf, errors.New("max_age age must not be negative")
+	}
+	conf.MaxCodeAge = config.MaxAge.Age
+	switch config.MaxAge.Stale {
+	case "", "flag":
+	case "suppress":
+		conf.SuppressStale = true
+	default:
+		return conf, fmt.Errorf("unknown max_age stale '%s', must be flag or suppress", config.MaxAge.Stale)
+	}
+
+	conf.OAuthProviders = map[string]*OAuthProvider{}
+	for name, p := range config.OAuth2 {
+		provider := OAuthProvider{
+			ClientID:     p.ClientID,
+			ClientSecret: p.ClientSecret,
+			AuthURL:      p.AuthURL,
+			DeviceURL:    p.DeviceURL,
+			TokenURL:     p.TokenURL,
+			Scopes:       p.Scopes,
+			AuthParams:   p.AuthParams,
+			Mechanism:    strings.ToLower(p.Mechanism),
+		}
+		if err := parseOAuthProvider(name, &provider); err != nil {
+			return conf, err
+		}
+		conf.OAuthProviders[name] = &provider
+	}
+
 	return conf, nil
 }
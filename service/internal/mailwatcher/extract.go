@@ -0,0 +1,278 @@
+package mailwatcher
+
+import (
+	"errors"
+	"log"
+	"path"
+	"reflect"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	"golang.org/x/text/unicode/norm"
+)
+
+var bodyFetchItems = []imap.FetchItem{imap.FetchItem("BODY.PEEK[] INTERNALDATE"), imap.FetchEnvelope}
+
+// envelopeFirst tells if the envelope and headers alone can settle some
+// emails. They can't once an extractor for the text applies to every email.
+func envelopeFirst(regs *[]Extractor) bool {
+	for _, re := range *regs {
+		if !re.Target.needsBody() || !re.Match.isEmpty() {
+			return true
+		}
+		if re.Target.matchesText() {
+			return false
+		}
+	}
+	return false
+}
+
+func hasBodyExtractors(regs *[]Extractor) bool {
+	for _, re := range *regs {
+		if re.Target.needsBody() {
+			return true
+		}
+	}
+	return false
+}
+
+// headerFetchItems fetches the envelope for the subject, and only the headers
+// extractors and the local filter ask for
+func headerFetchItems(config *Configuration) []imap.FetchItem {
+	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchInternalDate}
+	headers := []string{}
+	for _, re := range config.Extractors {
+		if re.Target == TargetHeader {
+			headers = append(headers, re.Header)
+		}
+	}
+	if config.LocalFilter != nil {
+		for _, h := range config.LocalFilter.Headers {
+			headers = append(headers, h.Name)
+		}
+	}
+	if len(headers) > 0 {
+		section := &imap.BodySectionName{
+			BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier, Fields: headers},
+			Peek:         true,
+		}
+		items = append(items, section.FetchItem())
+	}
+	return items
+}
+
+// fetchedHeader parses the header fields fetched with headerFetchItems
+func fetchedHeader(msg *imap.Message) *message.Header {
+	var header *message.Header
+	for _, literal := range msg.Body {
+		// Only the requested header fields, followed by an empty line
+		if e, err := message.Read(literal); err == nil || isUnknownMime(err) {
+			header = &e.Header
+		}
+	}
+	return header
+}
+
+// extractFromBody falls back to the heuristic, if it is enabled, once none of
+// the extractors found anything
+func extractFromBody(msg *imap.Message, config *Configuration) (EmailCode, error) {
+	c := EmailCode{}
+
+	for _, literal := range msg.Body {
+		body, err := decodeBody(literal)
+		if err != nil {
+			return c, err
+		}
+		// The text is what people read
+		if body.Text == "" {
+			body.Text = htmlToText(body.HTML)
+		}
+
+		if code, ok, _ := extractCode(msg, &body.Header, &body, &config.Extractors); ok {
+			return code, nil
+		}
+
+		if config.Heuristic {
+			code, confidence := guessCode(msg.Envelope.Subject, body.Text)
+			if code != "" && confidence >= config.HeuristicMinConfidence {
+				log.Printf("Guessed code with confidence %.2f\n", confidence)
+				return EmailCode{Sender: sender(msg), Code: code, Confidence: confidence}, nil
+			}
+		}
+
+		return c, errors.New("no codes found")
+	}
+	return c, errors.New("message had no body")
+}
+
+// extractCode tries the extractors that apply to the email in order on the
+// subject, headers and text, and only then on the raw HTML. Without a body it
+// stops at the first extractor for the text, so that no extractor further down
+// the list wins over it, and reports that the body is needed.
+func extractCode(msg *imap.Message, header *message.Header, body *emailBody, regs *[]Extractor) (EmailCode, bool, bool) {
+	needsBody := false
+	for _, re := range *regs {
+		if !re.Match.applies(msg.Envelope) {
+			continue
+		}
+		content := ""
+		switch {
+		case re.Target == TargetSubject:
+			content = msg.Envelope.Subject
+		case re.Target == TargetHeader:
+			content = headerText(header, re.Header)
+		case body == nil:
+			needsBody = true
+			if re.Target.matchesText() {
+				return EmailCode{}, false, true
+			}
+			continue
+		case re.Target.matchesText():
+			content = body.Text
+		default:
+			continue
+		}
+		if code, ok := matchExtractor(content, false, &re); ok {
+			return newEmailCode(msg, &re, code), true, false
+		}
+	}
+
+	if body == nil {
+		return EmailCode{}, false, needsBody
+	}
+	for _, re := range *regs {
+		if !re.Target.matchesHTML() || !re.Match.applies(msg.Envelope) {
+			continue
+		}
+		if code, ok := matchExtractor(body.HTML, true, &re); ok {
+			return newEmailCode(msg, &re, code), true, false
+		}
+	}
+	return EmailCode{}, false, false
+}
+
+func newEmailCode(msg *imap.Message, re *Extractor, value string) EmailCode {
+	if re.Link != nil {
+		return EmailCode{Sender: sender(msg), Link: value}
+	}
+	return EmailCode{Sender: sender(msg), Code: value, Confidence: 1}
+}
+
+// headerText joins the decoded values of all the header's fields
+func headerText(header *message.Header, key string) string {
+	if header == nil {
+		return ""
+	}
+	values := []string{}
+	fields := header.FieldsByKey(key)
+	for fields.Next() {
+		value, err := fields.Text()
+		if err != nil {
+			value = fields.Value()
+		}
+		values = append(values, value)
+	}
+	return strings.Join(values, "\n")
+}
+
+func sender(msg *imap.Message) string {
+	if msg.Envelope == nil || len(msg.Envelope.From) == 0 {
+		return ""
+	}
+	return msg.Envelope.From[0].Address()
+}
+
+// matches decides on an email by its envelope and fetched headers. Subjects
+// and header values are normalized to NFKC first, so that e.g. full-width
+// letters or decomposed umlauts match the patterns too.
+func (f *LocalFilter) matches(env *imap.Envelope, header *message.Header) bool {
+	if len(f.Subjects) == 0 && len(f.Senders) == 0 && len(f.Headers) == 0 {
+		return true
+	}
+	if env != nil {
+		subject := norm.NFKC.String(env.Subject)
+		for _, reg := range f.Subjects {
+			if reg.MatchString(subject) {
+				return true
+			}
+		}
+		if len(f.Senders) > 0 && matchAddresses(f.Senders, env.From) {
+			return true
+		}
+	}
+	for _, h := range f.Headers {
+		if value := headerText(header, h.Name); value != "" && h.Value.MatchString(norm.NFKC.String(value)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ExtractorMatch) applies(env *imap.Envelope) bool {
+	if m.isEmpty() {
+		return true
+	}
+	if env == nil {
+		return false
+	}
+	if len(m.Senders) > 0 && !matchAddresses(m.Senders, env.From) {
+		return false
+	}
+	if len(m.Recipients) > 0 && !matchAddresses(m.Recipients, append(append([]*imap.Address{}, env.To...), env.Cc...)) {
+		return false
+	}
+	return m.Subject == nil || m.Subject.MatchString(env.Subject)
+}
+
+func matchAddresses(patterns []string, addresses []*imap.Address) bool {
+	for _, addr := range addresses {
+		address := strings.ToLower(addr.Address())
+		_, domain, _ := strings.Cut(address, "@")
+		for _, pattern := range patterns {
+			pattern = strings.ToLower(pattern)
+			if !strings.Contains(pattern, "@") {
+				if matchDomain(pattern, domain) {
+					return true
+				}
+			} else if ok, _ := path.Match(pattern, address); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchDomain matches a domain glob against the domain itself and, so that
+// a domain also covers its subdomains, against their parent domains
+func matchDomain(pattern string, domain string) bool {
+	if ok, _ := path.Match(pattern, domain); ok {
+		return true
+	}
+	ok, _ := path.Match("*."+pattern, domain)
+	return ok
+}
+
+// matchExtractor returns the code or link the extractor finds in content
+func matchExtractor(content string, isHTML bool, re *Extractor) (string, bool) {
+	if content == "" {
+		return "", false
+	}
+	if re.Link != nil {
+		return matchLink(content, isHTML, re.Link)
+	}
+	parts := (&re.Reg).FindStringSubmatch(content)
+	if capName, ok := re.Capture.(string); ok {
+		capIdx := (&re.Reg).SubexpIndex(capName)
+		if capIdx > -1 && len(parts) > capIdx {
+			return parts[capIdx], true
+		}
+	} else if v, ok := re.Capture.(int); ok {
+		if len(parts) > v {
+			return parts[v], true
+		}
+	} else {
+		log.Panicf("Unexpected type of capture: %s", reflect.TypeOf(re.Capture).Name())
+	}
+	return "", false
+}
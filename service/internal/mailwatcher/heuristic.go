@@ -0,0 +1,199 @@
+package mailwatcher
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Words that announce a code, matched at the start of a word. Most codes come
+// right after one of them, some right before.
+var codeKeywords = []string{
+	"code", "verif", "vérif", "passcode", "one-time", "one time", "security", "authenti", "login", "log in", "sign-in", "sign in",
+	"código", "codigo", "clave", "codice", "bestätigung", "sicherheitscode", "anmelde", "einmal",
+	"weryfikac", "doğrulama", "dogrulama", "bekräft", "bekreft", "kode", "код", "подтвержд",
+}
+
+// Short keywords that have to be whole words. A "pin" isn't "shopping".
+var codeWords = []string{"pin", "otp", "tan", "kod", "2fa", "mfa"}
+
+// Scripts without spaces between words
+var codeKeywordsCJK = []string{"验证码", "驗證碼", "認証コード", "確認コード", "認証番号", "인증", "코드"}
+
+var (
+	keywordPattern = regexp.MustCompile(`(?i)(?:^|[^\p{L}\p{N}])(?:` + quoteAll(codeKeywords) + `)` +
+		`|(?:^|[^\p{L}\p{N}])(?:` + quoteAll(codeWords) + `)(?:$|[^\p{L}\p{N}])` +
+		`|` + quoteAll(codeKeywordsCJK))
+	wordPattern    = regexp.MustCompile(`[\p{L}\p{N}]+`)
+	addressPattern = regexp.MustCompile(`[^\s<>()"]+@[^\s<>()"]+`)
+)
+
+const (
+	// How far a keyword may be from the code
+	keywordNear = 40
+	keywordFar  = 150
+)
+
+// A possible code and where it is in the text
+type codeCandidate struct {
+	code       string
+	start, end int
+	digits     bool
+}
+
+// guessCode looks for the most likely code in the subject and text of an
+// email. The confidence is between 0 and 1.
+func guessCode(subject string, text string) (string, float64) {
+	text = subject + "\n\n" + text
+	// Numbers in links and addresses are never the code
+	text = urlPattern.ReplaceAllStringFunc(text, blankOut)
+	text = addressPattern.ReplaceAllStringFunc(text, blankOut)
+
+	keywords := keywordPattern.FindAllStringIndex(text, -1)
+	best, bestScore := "", 0.0
+	for _, c := range codeCandidates(text) {
+		if score := scoreCandidate(text, &c, keywords); score > bestScore {
+			best, bestScore = c.code, score
+		}
+	}
+	return best, bestScore
+}
+
+// codeCandidates returns 4-10 digit numbers, including ones written in two
+// groups like "123 456", and 4-10 character tokens of digits and capitals
+func codeCandidates(text string) []codeCandidate {
+	candidates := []codeCandidate{}
+	words := wordPattern.FindAllStringIndex(text, -1)
+	for i, w := range words {
+		word := text[w[0]:w[1]]
+		if len(word) >= 4 && len(word) <= 10 {
+			if isDigits(word) {
+				candidates = append(candidates, codeCandidate{code: word, start: w[0], end: w[1], digits: true})
+			} else if isCodeToken(word) {
+				candidates = append(candidates, codeCandidate{code: word, start: w[0], end: w[1]})
+			}
+		}
+
+		if i+1 < len(words) {
+			next := words[i+1]
+			sep := text[w[1]:next[0]]
+			group := word + text[next[0]:next[1]]
+			if (sep == " " || sep == "-") && len(word) >= 3 && len(word) <= 4 && len(group) <= 8 &&
+				isDigits(word) && isDigits(text[next[0]:next[1]]) && len(text[next[0]:next[1]]) >= 3 {
+				candidates = append(candidates, codeCandidate{code: group, start: w[0], end: next[1], digits: true})
+			}
+		}
+	}
+	return candidates
+}
+
+func scoreCandidate(text string, c *codeCandidate, keywords [][]int) float64 {
+	score := 0.1
+	if c.digits {
+		score = 0.2
+		if len(c.code) == 6 {
+			score += 0.1
+		}
+	}
+
+	bonus := 0.0
+	for _, k := range keywords {
+		switch {
+		case k[1] <= c.start && c.start-k[1] <= keywordNear:
+			bonus = max(bonus, 0.5)
+		case k[1] <= c.start && c.start-k[1] <= keywordFar:
+			bonus = max(bonus, 0.3)
+		case k[0] >= c.end && k[0]-c.end <= keywordNear:
+			bonus = max(bonus, 0.3)
+		}
+	}
+	score += bonus
+
+	if c.digits && len(c.code) == 4 && (strings.HasPrefix(c.code, "19") || strings.HasPrefix(c.code, "20")) {
+		// A year
+		score -= 0.3
+	}
+	if partOfNumber(text, c) {
+		// A date, time, phone number or amount
+		score -= 0.5
+	}
+	before := strings.TrimRight(text[:c.start], " ")
+	after := strings.TrimLeft(text[c.end:], " ")
+	if strings.HasSuffix(before, "#") || strings.HasSuffix(before, "+") || strings.HasSuffix(before, "(") {
+		// Order numbers and phone numbers
+		score -= 0.3
+	}
+	last, _ := utf8.DecodeLastRuneInString(before)
+	first, _ := utf8.DecodeRuneInString(after)
+	if strings.ContainsRune("$€£¥", last) || strings.ContainsRune("$€£¥%", first) {
+		// An amount
+		score -= 0.4
+	}
+	return min(max(score, 0), 1)
+}
+
+// partOfNumber tells if the candidate is joined to other digits by a
+// separator, as in 12.05.2024, 10:30, +1 555 123 4567 or 1,250.00
+func partOfNumber(text string, c *codeCandidate) bool {
+	before, after := text[:c.start], text[c.end:]
+	for _, sep := range []string{"/", ".", ":", ",", "-", " "} {
+		if strings.HasSuffix(before, sep) && endsWithDigit(strings.TrimSuffix(before, sep)) {
+			return true
+		}
+		if strings.HasPrefix(after, sep) && startsWithDigit(strings.TrimPrefix(after, sep)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isCodeToken accepts tokens like "A7K2QX" but not words, model numbers like
+// "iPhone15" or hex colors
+func isCodeToken(s string) bool {
+	digits := 0
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			digits++
+		case r < 'A' || r > 'Z':
+			return false
+		}
+	}
+	return digits >= 2 && digits < len(s)
+}
+
+func endsWithDigit(s string) bool {
+	return s != "" && s[len(s)-1] >= '0' && s[len(s)-1] <= '9'
+}
+
+func startsWithDigit(s string) bool {
+	return s != "" && s[0] >= '0' && s[0] <= '9'
+}
+
+// blankOut replaces s with spaces, but keeps its line breaks
+func blankOut(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return r
+		}
+		return ' '
+	}, s)
+}
+
+func quoteAll(words []string) string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = regexp.QuoteMeta(w)
+	}
+	return strings.Join(quoted, "|")
+}
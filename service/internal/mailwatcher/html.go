@@ -0,0 +1,109 @@
+package mailwatcher
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Elements whose content is never shown
+var hiddenElements = map[atom.Atom]bool{
+	atom.Head:     true,
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Template: true,
+	atom.Noscript: true,
+	atom.Title:    true,
+}
+
+// Elements that start on a line of their own
+var blockElements = map[atom.Atom]bool{
+	atom.Address: true, atom.Article: true, atom.Aside: true, atom.Blockquote: true,
+	atom.Center: true, atom.Dd: true, atom.Div: true, atom.Dl: true, atom.Dt: true,
+	atom.Fieldset: true, atom.Figcaption: true, atom.Figure: true, atom.Footer: true,
+	atom.Form: true, atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true,
+	atom.H5: true, atom.H6: true, atom.Header: true, atom.Hr: true, atom.Li: true,
+	atom.Main: true, atom.Nav: true, atom.Ol: true, atom.P: true, atom.Pre: true,
+	atom.Section: true, atom.Table: true, atom.Tbody: true, atom.Thead: true,
+	atom.Tfoot: true, atom.Tr: true, atom.Ul: true,
+}
+
+var (
+	displayNone = regexp.MustCompile(`(?i)display\s*:\s*none|visibility\s*:\s*hidden`)
+	whitespace  = regexp.MustCompile(`\s+`)
+	spaces      = regexp.MustCompile(`[ \t\f\v\x{a0}]+`)
+	blankLines  = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToText renders HTML roughly the way a mail client shows it: without
+// tags, styles, scripts and hidden elements, with entities decoded and a line
+// per block element. Table cells on the same row are separated by spaces.
+func htmlToText(s string) string {
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		return ""
+	}
+
+	var b strings.Builder
+	// Nested blocks share their line breaks
+	newline := func() {
+		if text := strings.TrimRight(b.String(), " "); text != "" && !strings.HasSuffix(text, "\n") {
+			b.WriteString("\n")
+		}
+	}
+	var render func(n *html.Node, pre bool)
+	render = func(n *html.Node, pre bool) {
+		switch n.Type {
+		case html.TextNode:
+			// Whitespace in the source doesn't show, outside of pre
+			if pre {
+				b.WriteString(n.Data)
+			} else {
+				b.WriteString(whitespace.ReplaceAllString(n.Data, " "))
+			}
+			return
+		case html.CommentNode:
+			return
+		case html.ElementNode:
+			if hiddenElements[n.DataAtom] || isHidden(n) {
+				return
+			}
+			switch {
+			case n.DataAtom == atom.Br:
+				b.WriteString("\n")
+				return
+			case n.DataAtom == atom.Td || n.DataAtom == atom.Th:
+				b.WriteString(" ")
+			case blockElements[n.DataAtom]:
+				newline()
+			}
+		}
+
+		pre = pre || n.DataAtom == atom.Pre
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			render(c, pre)
+		}
+
+		if n.Type == html.ElementNode && blockElements[n.DataAtom] {
+			newline()
+		}
+	}
+	render(doc, false)
+
+	lines := strings.Split(b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(spaces.ReplaceAllString(line, " "))
+	}
+	return strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
+
+func isHidden(n *html.Node) bool {
+	for _, attr := range n.Attr {
+		if attr.Key == "hidden" || (attr.Key == "style" && displayNone.MatchString(attr.Val)) {
+			return true
+		}
+	}
+	return false
+}
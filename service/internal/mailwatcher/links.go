@@ -0,0 +1,118 @@
+package mailwatcher
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Text doesn't say where a URL ends. It is taken up to whitespace, quotes or
+// angle brackets, without trailing punctuation.
+var urlPattern = regexp.MustCompile("(?i)https?://[^\\s<>\"'`]+")
+
+// Trackers are sometimes wrapped in trackers
+const maxRedirectDepth = 3
+
+// matchLink returns the first link in content that matches the pattern. In
+// HTML only the targets of anchors count. Tracking redirects are decoded from
+// their URL, they are never followed: that could use up a one-time link.
+func matchLink(content string, isHTML bool, link *LinkPattern) (string, bool) {
+	var links []string
+	if isHTML {
+		links = htmlLinks(content)
+	} else {
+		links = textLinks(content)
+	}
+	for _, raw := range links {
+		if target, ok := resolveLink(raw, link, 0); ok {
+			return target, true
+		}
+	}
+	return "", false
+}
+
+func textLinks(s string) []string {
+	links := urlPattern.FindAllString(s, -1)
+	for i, link := range links {
+		links[i] = strings.TrimRight(link, ".,;:!?)]}")
+	}
+	return links
+}
+
+func htmlLinks(s string) []string {
+	links := []string{}
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return links
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) != "a" && string(name) != "area" {
+				continue
+			}
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				if string(key) == "href" {
+					links = append(links, strings.TrimSpace(string(val)))
+				}
+			}
+		}
+	}
+}
+
+// resolveLink returns the link, or the first URL it redirects to, that
+// matches the pattern
+func resolveLink(raw string, link *LinkPattern, depth int) (string, bool) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", false
+	}
+	if link.matches(u) {
+		return u.String(), true
+	}
+	if depth >= maxRedirectDepth {
+		return "", false
+	}
+	for _, target := range redirectTargets(u) {
+		if resolved, ok := resolveLink(target, link, depth+1); ok {
+			return resolved, true
+		}
+	}
+	return "", false
+}
+
+// redirectTargets returns the URLs a tracking link carries, either as a query
+// parameter (?url=https%3A%2F%2F...) or as an escaped path segment
+// (/L0/https:%2F%2F.../1/...)
+func redirectTargets(u *url.URL) []string {
+	targets := []string{}
+	// In their order in the URL, unlike url.Values
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		_, value, _ := strings.Cut(param, "=")
+		if value, err := url.QueryUnescape(value); err == nil && isAbsoluteURL(value) {
+			targets = append(targets, value)
+		}
+	}
+	for _, segment := range strings.Split(u.EscapedPath(), "/") {
+		if value, err := url.PathUnescape(segment); err == nil && isAbsoluteURL(value) {
+			targets = append(targets, value)
+		}
+	}
+	return targets
+}
+
+func isAbsoluteURL(s string) bool {
+	s = strings.ToLower(s)
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
+
+func (l *LinkPattern) matches(u *url.URL) bool {
+	if !matchDomain(l.Host, strings.ToLower(u.Hostname())) {
+		return false
+	}
+	return l.Path == nil || l.Path.MatchString(u.Path)
+}
@@ -4,9 +4,10 @@ import (
 	"container/list"
 	"errors"
 	"fmt"
-	"io"
 	"log"
-	"reflect"
+	"net"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,28 +15,121 @@ import (
 	"github.com/emersion/go-imap/client"
 )
 
+const (
+	dialTimeout   = 30 * time.Second
+	logoutTimeout = 10 * time.Second
+)
+
+// Either a code or a verification link
 type EmailCode struct {
-	Sender string
-	Code   string
+	Mailbox string
+	Sender  string
+	Code    string
+	Link    string
+	// 1 unless the code was guessed by the heuristic
+	Confidence float64
+	// Of the email, empty if it has none
+	MessageID string
+	Folder    string
+	Uid       uint32
+	Subject   string
+	// From the Date header and when the server received the email. Either
+	// can be zero.
+	Date        time.Time
+	ReceivedAt  time.Time
+	ExtractedAt time.Time
+	// Older than the configured max age
+	Stale bool
+}
+
+func (c *EmailCode) IsLink() bool {
+	return c.Link != ""
+}
+
+type MailboxState int32
+
+const (
+	Stopped      MailboxState = 0
+	Connecting   MailboxState = 1
+	Watching     MailboxState = 2
+	Reconnecting MailboxState = 3
+	// Stopped because of an error reconnecting won't fix
+	Failed MailboxState = 4
+	// Like Watching, for servers without IDLE
+	Polling MailboxState = 5
+)
+
+// MailboxEvents are published whenever a mailbox changes state or runs into
+// an error. Error is empty for plain state changes. NextRetry is only set
+// while reconnecting.
+type MailboxEvent struct {
+	Mailbox   string
+	State     MailboxState
+	Error     string
+	NextRetry time.Time
+	Time      time.Time
+}
+
+type MailboxStatus struct {
+	Email          string
+	State          MailboxState
+	ConnectedSince time.Time
+	LastIdle       time.Time
+	LastFetch      time.Time
+	LastCode       time.Time
+	LastError      string
+	LastErrorAt    time.Time
+	Reconnects     int
+	NextRetry      time.Time
 }
 
 type MailboxContext struct {
-	mailbox     *Mailbox
-	doneChannel chan struct{}
-	isRunning   bool
-	rwMtx       sync.RWMutex
+	mailbox      *Mailbox
+	repo         *Repository
+	doneChannel  chan struct{}
+	stopOnce     sync.Once
+	eventChannel chan MailboxEvent
+	status       MailboxStatus
+	// The current OAuth2 access token, kept across reconnects
+	token OAuthToken
+	rwMtx sync.RWMutex
+}
+
+func (s MailboxState) ToString() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Watching:
+		return "watching"
+	case Reconnecting:
+		return "reconnecting"
+	case Failed:
+		return "failed"
+	case Polling:
+		return "polling"
+	default:
+		return "stopped"
+	}
+}
+
+func newMailboxContext(mb *Mailbox, repo *Repository, eventChannel chan MailboxEvent) *MailboxContext {
+	ctx := new(MailboxContext)
+	ctx.mailbox = mb
+	ctx.repo = repo
+	ctx.doneChannel = make(chan struct{})
+	ctx.eventChannel = eventChannel
+	ctx.status.Email = mb.Email
+	// Counts as running until the goroutine gives up, so that it isn't started twice
+	ctx.status.State = Connecting
+	return ctx
 }
 
-func WatchMailboxes(mailboxes *list.List, config *Configuration, codeChannel chan EmailCode) (map[string]*MailboxContext, error) {
+func WatchMailboxes(mailboxes *list.List, repo *Repository, config *Configuration, codeChannel chan EmailCode, eventChannel chan MailboxEvent) (map[string]*MailboxContext, error) {
 	contexts := map[string]*MailboxContext{}
 
 	for e := mailboxes.Front(); e != nil; e = e.Next() {
 		mb := e.Value.(*Mailbox)
-		contexts[mb.Email] = new(MailboxContext)
-		contexts[mb.Email].mailbox = mb
-		contexts[mb.Email].doneChannel = make(chan struct{})
-		contexts[mb.Email].isRunning = false
-		contexts[mb.Email].rwMtx = sync.RWMutex{}
+		contexts[mb.Email] = newMailboxContext(mb, repo, eventChannel)
 
 		go watchMailbox(contexts[mb.Email], config, codeChannel)
 	}
@@ -43,11 +137,8 @@ func WatchMailboxes(mailboxes *list.List, config *Configuration, codeChannel cha
 	return contexts, nil
 }
 
-func WatchMailbox(mb *Mailbox, config *Configuration, codeChannel chan EmailCode) *MailboxContext {
-	ctx := new(MailboxContext)
-	ctx.mailbox = mb
-	ctx.doneChannel = make(chan struct{})
-	ctx.isRunning = false
+func WatchMailbox(mb *Mailbox, repo *Repository, config *Configuration, codeChannel chan EmailCode, eventChannel chan MailboxEvent) *MailboxContext {
+	ctx := newMailboxContext(mb, repo, eventChannel)
 
 	go watchMailbox(ctx, config, codeChannel)
 	return ctx
@@ -61,137 +152,639 @@ func StopWatchingMailboxes(ctxs *map[string]*MailboxContext) {
 	}
 }
 
+// StopWatchingMailbox doesn't wait for the mailbox to stop and may be called
+// more than once.
 func StopWatchingMailbox(ctx *MailboxContext) {
-	log.Printf("Stopping %s", ctx.mailbox.Email)
-	ctx.doneChannel <- struct{}{}
+	ctx.stopOnce.Do(func() {
+		log.Printf("Stopping %s", ctx.mailbox.Email)
+		close(ctx.doneChannel)
+	})
 }
 
 func IsRunning(ctx *MailboxContext) bool {
 	ctx.rwMtx.RLock()
-	running := ctx.isRunning
+	running := ctx.status.State != Stopped && ctx.status.State != Failed
 	ctx.rwMtx.RUnlock()
 	return running
 }
 
+func GetStatus(ctx *MailboxContext) MailboxStatus {
+	ctx.rwMtx.RLock()
+	status := ctx.status
+	ctx.rwMtx.RUnlock()
+	return status
+}
+
+func (ctx *MailboxContext) updateStatus(update func(*MailboxStatus)) {
+	ctx.rwMtx.Lock()
+	update(&ctx.status)
+	ctx.rwMtx.Unlock()
+}
+
+func (ctx *MailboxContext) setState(state MailboxState) {
+	ctx.rwMtx.Lock()
+	changed := ctx.status.State != state
+	ctx.status.State = state
+	ctx.rwMtx.Unlock()
+
+	if changed {
+		ctx.publish(MailboxEvent{State: state})
+	}
+}
+
+func (ctx *MailboxContext) fail(err error) {
+	log.Println(err)
+	ctx.rwMtx.Lock()
+	state := ctx.status.State
+	ctx.status.LastError = err.Error()
+	ctx.status.LastErrorAt = time.Now()
+	ctx.rwMtx.Unlock()
+
+	ctx.publish(MailboxEvent{State: state, Error: err.Error()})
+}
+
+func (ctx *MailboxContext) reconnecting(delay time.Duration) {
+	retry := time.Now().Add(delay)
+	ctx.rwMtx.Lock()
+	ctx.status.State = Reconnecting
+	ctx.status.Reconnects++
+	ctx.status.NextRetry = retry
+	ctx.rwMtx.Unlock()
+
+	log.Printf("Reconnecting to %s in %s\n", ctx.mailbox.Email, delay.Round(time.Millisecond))
+	ctx.publish(MailboxEvent{State: Reconnecting, NextRetry: retry})
+}
+
+func (ctx *MailboxContext) publish(ev MailboxEvent) {
+	if ctx.eventChannel == nil {
+		return
+	}
+	ev.Mailbox = ctx.mailbox.Email
+	ev.Time = time.Now()
+	ctx.eventChannel <- ev
+}
+
+// watchMailbox keeps a session to the mailbox open until it is stopped,
+// reconnecting with a backoff whenever the session fails. Only permanent
+// errors, like rejected credentials, end it early.
 func watchMailbox(ctx *MailboxContext, config *Configuration, codeChannel chan EmailCode) {
+	finalState := Stopped
+	defer func() {
+		ctx.updateStatus(func(st *MailboxStatus) {
+			st.ConnectedSince = time.Time{}
+			st.NextRetry = time.Time{}
+		})
+		ctx.setState(finalState)
+		log.Printf("Stopped watching %s.\n", ctx.mailbox.Email)
+	}()
+
+	retry := newBackoff(config)
+	for {
+		connectedFor, err := watchSession(ctx, config, codeChannel)
+		if err == nil {
+			return
+		}
+
+		ctx.fail(err)
+		if isPermanent(err) {
+			finalState = Failed
+			return
+		}
+
+		if connectedFor >= stableSessionDuration {
+			retry.reset()
+		}
+		delay := retry.next()
+		ctx.reconnecting(delay)
+
+		select {
+		case <-ctx.doneChannel:
+			return
+		case <-time.After(delay):
+		}
+		ctx.setState(Connecting)
+	}
+}
+
+// An IMAP connection with its updates drained. IDLE only reports changes to
+// the selected folder, so every idling folder gets a connection of its own.
+type imapConn struct {
+	*client.Client
+	// Signalled whenever the server reports new emails in the selected folder
+	newEmails chan struct{}
+	codes     *statusCodes
+}
+
+// dial connects and logs in
+func dial(ctx *MailboxContext, config *Configuration) (*imapConn, error) {
 	var c *client.Client = nil
-	var err error = nil
-	if ctx.mailbox.UseSSL {
-		c, err = client.DialTLS(fmt.Sprintf("%s:%d", ctx.mailbox.Server, ctx.mailbox.Port), nil)
+	tlsConf, err := tlsConfig(ctx.mailbox)
+	if err != nil {
+		// Trying again won't fix the files
+		return nil, &permanentError{err}
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if ctx.mailbox.TLS.Mode == TLSImplicit {
+		c, err = client.DialWithDialerTLS(dialer, fmt.Sprintf("%s:%d", ctx.mailbox.Server, ctx.mailbox.Port), tlsConf)
 	} else {
-		c, err = client.Dial(fmt.Sprintf("%s:%d", ctx.mailbox.Server, ctx.mailbox.Port))
+		c, err = client.DialWithDialer(dialer, fmt.Sprintf("%s:%d", ctx.mailbox.Server, ctx.mailbox.Port))
 	}
 
 	if err != nil {
-		log.Println(err)
-		return
+		return nil, err
+	}
+	conn := &imapConn{Client: c, newEmails: make(chan struct{}, 1), codes: &statusCodes{}}
+
+	// A connection that silently died fails the next command instead of
+	// blocking it forever
+	c.Timeout = commandTimeout(config)
+
+	// go-imap blocks until updates are received, so they are always drained
+	// and only the fact that new emails arrived is kept
+	updates := make(chan client.Update, 16)
+	c.Updates = updates
+	go func() {
+		for {
+			select {
+			case upd := <-updates:
+				if _, ok := upd.(*client.MailboxUpdate); ok {
+					select {
+					case conn.newEmails <- struct{}{}:
+					default:
+					}
+				}
+			case <-c.LoggedOut():
+				return
+			}
+		}
+	}()
+
+	// Only what the server sends is seen, never the credentials
+	c.SetDebug(imap.NewDebugWriter(nil, conn.codes))
+
+	if ctx.mailbox.TLS.Mode == TLSStartTLS {
+		if err := startTLS(c, tlsConf); err != nil {
+			conn.logout()
+			return nil, err
+		}
 	}
 
-	err = c.Login(ctx.mailbox.Email, ctx.mailbox.Password)
-	defer c.Logout()
+	conn.codes.arm()
+	if ctx.mailbox.OAuthProvider != "" {
+		err = authenticateOAuth(ctx, c, config)
+	} else {
+		err = c.Login(ctx.mailbox.Email, ctx.mailbox.Password)
+	}
+	code := conn.codes.take()
 	if err != nil {
-		log.Println(err)
-		return
+		conn.logout()
+		return nil, classifyLoginError(err, code)
 	}
+	return conn, nil
+}
+
+// Never let a dead connection block logging out
+func (c *imapConn) logout() {
+	c.Timeout = logoutTimeout
+	c.Logout()
+}
+
+// watchSession connects, logs in and then watches every folder of the
+// mailbox. With IDLE, each folder idles on a connection of its own, polling
+// takes turns on a single one. It returns nil once the mailbox is stopped,
+// together with how long it was logged in. The first folder that fails ends
+// the whole session, so that all of them reconnect together.
+func watchSession(ctx *MailboxContext, config *Configuration, codeChannel chan EmailCode) (time.Duration, error) {
+	c, err := dial(ctx, config)
+	if err != nil {
+		return 0, err
+	}
+	conns := []*imapConn{c}
+	defer func() {
+		for _, conn := range conns {
+			conn.logout()
+		}
+	}()
 
 	log.Printf("Starting to watch %s...\n", ctx.mailbox.Email)
+	connectedAt := time.Now()
+	ctx.updateStatus(func(st *MailboxStatus) {
+		st.ConnectedSince = connectedAt
+		st.NextRetry = time.Time{}
+	})
+	defer ctx.updateStatus(func(st *MailboxStatus) { st.ConnectedSince = time.Time{} })
+
+	idle := !ctx.mailbox.DisableIdle
+	if idle {
+		if idle, err = c.Support("IDLE"); err != nil {
+			return time.Since(connectedAt), err
+		}
+		if !idle {
+			log.Printf("%s doesn't support IDLE, polling every %s\n", ctx.mailbox.Server, pollInterval(config))
+		}
+	}
 
-	ctx.rwMtx.Lock()
-	ctx.isRunning = true
-	ctx.rwMtx.Unlock()
+	folders, err := watchedFolders(c, ctx.mailbox)
+	if err != nil {
+		return time.Since(connectedAt), err
+	}
+	if !idle {
+		ctx.setState(Polling)
+		return time.Since(connectedAt), pollFolders(ctx, c, folders, config, codeChannel)
+	}
 
-	defer func() {
-		ctx.rwMtx.Lock()
-		ctx.isRunning = false
-		log.Printf("Stopped watching %s.\n", ctx.mailbox.Email)
-		ctx.rwMtx.Unlock()
+	for range folders[1:] {
+		conn, err := dial(ctx, config)
+		if err != nil {
+			return time.Since(connectedAt), err
+		}
+		conns = append(conns, conn)
+	}
+
+	selected := make([]*imap.MailboxStatus, len(folders))
+	for i, folder := range folders {
+		// Missing folders were already caught by watchedFolders, so whatever
+		// else the server refuses, like [INUSE] or [LIMIT], may go away
+		if selected[i], err = conns[i].Select(folder, false); err != nil {
+			return time.Since(connectedAt), fmt.Errorf("selecting folder %s: %w", folder, err)
+		}
+	}
+
+	stop := make(chan struct{})
+	errs := make(chan error, len(folders))
+	for i, folder := range folders {
+		go func(c *imapConn, folder string, uidValidity uint32) {
+			errs <- watchFolder(ctx, c, folder, uidValidity, config, codeChannel, stop)
+		}(conns[i], folder, selected[i].UidValidity)
+	}
+	ctx.setState(Watching)
+
+	running := len(folders)
+	select {
+	case <-ctx.doneChannel:
+	case err = <-errs:
+		running--
+	}
+	close(stop)
+	for ; running > 0; running-- {
+		<-errs
+	}
+	return time.Since(connectedAt), err
+}
+
+// watchedFolders returns the configured folders, or INBOX, together with the
+// junk folder if the server marks one with the SPECIAL-USE \Junk attribute.
+// A configured folder the server doesn't list is a permanent error,
+// reconnecting won't make it appear.
+func watchedFolders(c *imapConn, mb *Mailbox) ([]string, error) {
+	folders := mb.Folders
+	if len(folders) == 0 {
+		folders = []string{"INBOX"}
+	}
+
+	infos := make(chan *imap.MailboxInfo, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", "*", infos)
 	}()
 
-	if _, err = c.Select("INBOX", false); err != nil {
-		log.Println(err)
-		return
+	junk, listed := "", map[string]bool{}
+	for info := range infos {
+		listed[info.Name] = true
+		for _, attr := range info.Attributes {
+			if attr == imap.JunkAttr && junk == "" {
+				junk = info.Name
+			}
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, err
 	}
 
-	updates := make(chan client.Update)
-	paused := make(chan error, 1)
+	for _, folder := range folders {
+		// INBOX is case-insensitive and always exists
+		if !strings.EqualFold(folder, "INBOX") && !listed[folder] {
+			return nil, &permanentError{fmt.Errorf("folder %s doesn't exist", folder)}
+		}
+	}
 
-	c.Updates = updates
+	if junk != "" && !slices.Contains(folders, junk) {
+		log.Printf("Also watching %s's junk folder %s\n", mb.Email, junk)
+		folders = append(slices.Clip(folders), junk)
+	}
+	return folders, nil
+}
+
+// folderProgress returns where processing of the selected folder left off.
+// It starts over if the server renumbered the folder.
+func folderProgress(ctx *MailboxContext, folder string, uidValidity uint32) (FolderProgress, error) {
+	progress, err := ctx.repo.GetProgress(ctx.mailbox.Email, folder)
+	if err != nil {
+		return progress, err
+	}
+	// The server renumbered the folder, so the UIDs seen so far say nothing
+	if progress.UidValidity != uidValidity {
+		if progress.UidValidity != 0 {
+			log.Printf("UIDVALIDITY of %s in %s changed, processing it from the start\n", folder, ctx.mailbox.Email)
+		}
+		progress.UidValidity = uidValidity
+		progress.LastUid = 0
+		if err := ctx.repo.SaveProgress(&progress); err != nil {
+			return progress, err
+		}
+		if err := ctx.repo.RemoveStaleDeletions(ctx.mailbox.Email, folder, uidValidity); err != nil {
+			return progress, err
+		}
+	}
+	return progress, nil
+}
+
+// pollFolders selects the folders in turn on a single connection and fetches
+// their new emails, every config.PollInterval or once a deletion is due. It
+// returns nil once the mailbox is stopped.
+func pollFolders(ctx *MailboxContext, c *imapConn, folders []string, config *Configuration, codeChannel chan EmailCode) error {
+	for {
+		next := time.Time{}
+		for _, folder := range folders {
+			// Every poll doubles as a probe of the connection
+			selected, err := c.Select(folder, false)
+			if err != nil {
+				return fmt.Errorf("selecting folder %s: %w", folder, err)
+			}
+			progress, err := folderProgress(ctx, folder, selected.UidValidity)
+			if err != nil {
+				return err
+			}
+			if err := processEmails(ctx, c.Client, &progress, config, codeChannel); err != nil {
+				return fmt.Errorf("%s: %w", folder, err)
+			}
+			// Also picks up deletions scheduled before a restart
+			due, err := deleteDueEmails(ctx, c.Client, &progress)
+			if err != nil {
+				return fmt.Errorf("%s: %w", folder, err)
+			}
+			if !due.IsZero() && (next.IsZero() || due.Before(next)) {
+				next = due
+			}
+		}
+
+		select {
+		case <-ctx.doneChannel:
+			return nil
+		case <-c.newEmails:
+		case <-time.After(pollInterval(config)):
+		case <-timerUntil(next):
+		}
+	}
+}
+
+// watchFolder idles on the selected folder until new emails arrive to fetch
+// them. It returns nil once stop is closed.
+func watchFolder(ctx *MailboxContext, c *imapConn, folder string, uidValidity uint32, config *Configuration, codeChannel chan EmailCode, stop chan struct{}) error {
+	progress, err := folderProgress(ctx, folder, uidValidity)
+	if err != nil {
+		return err
+	}
 
+	fetch := true
 	for {
-		stop := make(chan struct{})
+		// Fetching before waiting also picks up emails that arrived while
+		// disconnected
+		if fetch {
+			if err := processEmails(ctx, c.Client, &progress, config, codeChannel); err != nil {
+				return fmt.Errorf("%s: %w", folder, err)
+			}
+		}
+		fetch = true
+
+		// Also picks up deletions scheduled before a restart
+		next, err := deleteDueEmails(ctx, c.Client, &progress)
+		if err != nil {
+			return fmt.Errorf("%s: %w", folder, err)
+		}
+		deletionDue := timerUntil(next)
+
+		// IDLE may legitimately go without an answer for as long as it
+		// lasts, so it runs without a deadline and is left regularly
+		// instead, both to restart it before the server logs us out and to
+		// find out whether the connection is still alive
+		stopIdling := make(chan struct{})
+		paused := make(chan error, 1)
+		c.Timeout = 0
 		go func() {
-			paused <- c.Idle(stop, nil)
+			paused <- c.Idle(stopIdling, &client.IdleOptions{LogoutTimeout: -1})
 		}()
+		ctx.updateStatus(func(st *MailboxStatus) { st.LastIdle = time.Now() })
+		refresh := time.NewTimer(keepaliveInterval(config))
+
+		select {
+		case <-stop:
+			refresh.Stop()
+			stopIdle(c.Client, stopIdling, paused, config)
+			return nil
+		case err := <-paused:
+			refresh.Stop()
+			// Idle only returns by itself on errors
+			if err == nil {
+				err = errors.New("stopped idling unexpectedly")
+			}
+			return fmt.Errorf("%s: %w", folder, err)
+		case <-c.newEmails:
+			refresh.Stop()
+			if err := stopIdle(c.Client, stopIdling, paused, config); err != nil {
+				return fmt.Errorf("%s: %w", folder, err)
+			}
+		case <-refresh.C:
+			if err := stopIdle(c.Client, stopIdling, paused, config); err != nil {
+				return fmt.Errorf("%s: %w", folder, err)
+			}
+			if err := c.Noop(); err != nil {
+				return fmt.Errorf("%s: keepalive failed: %w", folder, err)
+			}
+			// Updates that arrived in the meantime are still pending in
+			// newEmails and end the next IDLE right away
+			fetch = false
+		case <-deletionDue:
+			refresh.Stop()
+			if err := stopIdle(c.Client, stopIdling, paused, config); err != nil {
+				return fmt.Errorf("%s: %w", folder, err)
+			}
+			fetch = false
+		}
+	}
+}
 
-		stopped := false
-		for {
-			finishedIdling := false
-			select {
-			case <-ctx.doneChannel:
-				close(stop)
-				return
-			case err = <-paused:
-				if err != nil {
-					log.Println(err)
+// stopIdle leaves IDLE and restores the command timeout. The server has to
+// confirm leaving IDLE, which never happens on a dead connection, so that is
+// bounded by the command timeout as well.
+func stopIdle(c *client.Client, stop chan struct{}, paused chan error, config *Configuration) error {
+	close(stop)
+	timeout := time.NewTimer(commandTimeout(config))
+	defer timeout.Stop()
+
+	var err error
+	select {
+	case err = <-paused:
+	case <-timeout.C:
+		c.Terminate()
+		<-paused
+		err = errors.New("timed out leaving IDLE")
+	}
+	c.Timeout = commandTimeout(config)
+	return err
+}
+
+func pollInterval(config *Configuration) time.Duration {
+	if config.PollInterval <= 0 {
+		return defaultPollInterval
+	}
+	return config.PollInterval
+}
+
+func keepaliveInterval(config *Configuration) time.Duration {
+	if config.KeepaliveInterval <= 0 {
+		return defaultKeepaliveInterval
+	}
+	return min(config.KeepaliveInterval, maxKeepaliveInterval)
+}
+
+func commandTimeout(config *Configuration) time.Duration {
+	if config.CommandTimeout <= 0 {
+		return defaultCommandTimeout
+	}
+	return config.CommandTimeout
+}
+
+// processEmails extracts codes from the emails that arrived since the last
+// time, runs the mailbox's actions on them and remembers how far it got.
+// Extractors for the subject and headers run first, bodies are only
+// downloaded for emails they found no code in.
+func processEmails(ctx *MailboxContext, c *client.Client, progress *FolderProgress, config *Configuration, codeChannel chan EmailCode) error {
+	subjects := &config.Subjects
+	if config.LocalFilter != nil {
+		// Every new email, the filter picks from their envelopes
+		subjects = &[]string{}
+	}
+	matches, lastUid, err := searchEmails(c, progress.LastUid, subjects)
+	if err != nil {
+		return err
+	}
+
+	extracted := new(imap.SeqSet)
+	found := func(msg *imap.Message, code EmailCode) {
+		code.Mailbox = ctx.mailbox.Email
+		code.Folder = progress.Folder
+		code.Uid = msg.Uid
+		if msg.Envelope != nil {
+			code.MessageID = msg.Envelope.MessageId
+			code.Subject = msg.Envelope.Subject
+			code.Date = msg.Envelope.Date
+		}
+		code.ReceivedAt = msg.InternalDate
+		code.ExtractedAt = time.Now()
+		code.Stale = isStale(config, &code)
+		if code.Stale && config.SuppressStale {
+			log.Printf("Not sending stale code from %s in %s\n", code.Sender, code.Mailbox)
+		} else {
+			codeChannel <- code
+		}
+		ctx.updateStatus(func(st *MailboxStatus) { st.LastCode = time.Now() })
+		extracted.AddNum(msg.Uid)
+	}
+
+	if !matches.Empty() && config.LocalFilter == nil {
+		log.Println("Found potential verification code email")
+	}
+
+	withoutCode := matches
+	if !matches.Empty() && (envelopeFirst(&config.Extractors) || config.LocalFilter != nil) {
+		withoutCode = new(imap.SeqSet)
+		err = fetchMessages(c, matches, headerFetchItems(config), func(msg *imap.Message) {
+			header := fetchedHeader(msg)
+			if config.LocalFilter != nil {
+				if !config.LocalFilter.matches(msg.Envelope, header) {
 					return
 				}
-				finishedIdling = true
-			case <-updates:
-				if !stopped {
-					stop <- struct{}{}
-					close(stop)
-					stopped = true
-				}
+				log.Println("Found potential verification code email")
 			}
 
-			if finishedIdling {
-				break
+			if code, ok, needsBody := extractCode(msg, header, nil, &config.Extractors); ok {
+				found(msg, code)
+			} else if needsBody || config.Heuristic {
+				withoutCode.AddNum(msg.Uid)
 			}
+		})
+		if err != nil {
+			return err
 		}
+	}
 
-		messages := make(chan *imap.Message)
-		done := make(chan error, 1)
-		go func() {
-			done <- fetchEmails(c, &config.Subjects, messages)
-		}()
-
-		seenUids := new(imap.SeqSet)
-		for msg := range messages {
-			code, extractErr := extractCode(msg, &config.Extractors)
+	if !withoutCode.Empty() && (hasBodyExtractors(&config.Extractors) || config.Heuristic) {
+		err = fetchMessages(c, withoutCode, bodyFetchItems, func(msg *imap.Message) {
+			code, extractErr := extractFromBody(msg, config)
 			if extractErr != nil {
 				log.Println(extractErr)
 			} else {
-				codeChannel <- code
-				seenUids.AddNum(msg.SeqNum)
+				found(msg, code)
 			}
+		})
+		if err != nil {
+			return err
 		}
+	}
+	ctx.updateStatus(func(st *MailboxStatus) { st.LastFetch = time.Now() })
 
-		if err := <-done; err != nil {
-			log.Println(err)
-			return
+	// Saved first, so that emails whose actions fail aren't extracted again
+	if lastUid != progress.LastUid {
+		progress.LastUid = lastUid
+		if err := ctx.repo.SaveProgress(progress); err != nil {
+			return err
 		}
+	}
 
-		if !seenUids.Empty() {
-			item := imap.FormatFlagsOp(imap.AddFlags, true)
-			flags := []interface{}{imap.SeenFlag}
-			errChan := make(chan error, 1)
-			go func() {
-				errChan <- c.Store(seenUids, item, flags, nil)
-			}()
-			if err := <-errChan; err != nil {
-				log.Println(err)
-				return
-			}
+	if err := applyPostActions(ctx, c, progress, extracted); err != nil {
+		if isNetworkError(err) {
+			return err
 		}
+		// Reconnecting won't change the server's mind, the emails are left
+		// as they are
+		ctx.fail(fmt.Errorf("%s: %w", progress.Folder, err))
 	}
+	return nil
 }
 
-func fetchEmails(c *client.Client, subjects *[]string, messages chan *imap.Message) error {
+// searchEmails returns the new emails matching the subjects and the highest
+// UID in the folder it has seen. Only emails since yesterday are considered,
+// also when the folder is processed for the first time.
+func searchEmails(c *client.Client, lastUid uint32, subjects *[]string) (*imap.SeqSet, uint32, error) {
 	now := time.Now()
 	criteria := imap.NewSearchCriteria()
 	criteria.Since = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local).Add(time.Duration(-24) * time.Hour)
-	criteria.WithoutFlags = []string{imap.SeenFlag}
+	if lastUid > 0 {
+		criteria.Uid = new(imap.SeqSet)
+		criteria.Uid.AddRange(lastUid+1, 0)
+	}
+
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return nil, lastUid, err
+	}
 
+	newUids := new(imap.SeqSet)
+	highest := lastUid
+	for _, uid := range uids {
+		// "n:*" always matches the last email, even if its UID is below n
+		if uid > lastUid {
+			newUids.AddNum(uid)
+			highest = max(highest, uid)
+		}
+	}
+	if newUids.Empty() || len(*subjects) == 0 {
+		return newUids, highest, nil
+	}
+
+	criteria = imap.NewSearchCriteria()
+	criteria.Uid = newUids
 	if len(*subjects) == 1 {
 		criteria.Header.Add("SUBJECT", (*subjects)[0])
 	} else if len(*subjects) > 1 {
@@ -218,60 +811,25 @@ func fetchEmails(c *client.Client, subjects *[]string, messages chan *imap.Messa
 		}
 	}
 
-	uids, err := c.UidSearch(criteria)
-	if err != nil {
-		return err
-	}
-
-	if len(uids) > 0 {
-		log.Println("Found potential verification code email")
-		seqset := new(imap.SeqSet)
-		seqset.AddNum(uids...)
-		return c.UidFetch(seqset, []imap.FetchItem{imap.FetchItem("BODY.PEEK[TEXT] INTERNALDATE"), imap.FetchEnvelope}, messages)
+	if uids, err = c.UidSearch(criteria); err != nil {
+		return nil, lastUid, err
 	}
-
-	close(messages)
-	return nil
+	matches := new(imap.SeqSet)
+	matches.AddNum(uids...)
+	return matches, highest, nil
 }
 
-func extractCode(msg *imap.Message, regs *[]Extractor) (EmailCode, error) {
-	c := EmailCode{}
-
-	for _, literal := range msg.Body {
-		body, err := io.ReadAll(literal)
-		if err != nil {
-			return c, err
-		}
-
-		sender := ""
-		if len(msg.Envelope.From) > 0 {
-			sender = msg.Envelope.From[0].Address()
-		}
-
-		strBody := string(body)
-		for _, re := range *regs {
-			parts := (&re.Reg).FindStringSubmatch(strBody)
-			if capName, ok := re.Capture.(string); ok {
-				capIdx := (&re.Reg).SubexpIndex(capName)
-				if capIdx > -1 && len(parts) > capIdx {
-					return EmailCode{
-						Sender: sender,
-						Code:   parts[capIdx],
-					}, nil
-				}
-			} else if v, ok := re.Capture.(int); ok {
-				if len(parts) > v {
-					return EmailCode{
-						Sender: sender,
-						Code:   parts[v],
-					}, nil
-				}
-			} else {
-				log.Panicf("Unexpected type of capture: %s", reflect.TypeOf(re.Capture).Name())
-			}
-		}
+// fetchMessages passes every fetched email to handle while they are still
+// being received, so their literals have to be read right away.
+func fetchMessages(c *client.Client, uids *imap.SeqSet, items []imap.FetchItem, handle func(*imap.Message)) error {
+	messages := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(uids, items, messages)
+	}()
 
-		return c, errors.New("no codes found")
+	for msg := range messages {
+		handle(msg)
 	}
-	return c, errors.New("message had no body")
+	return <-done
 }
@@ -0,0 +1,416 @@
+package mailwatcher
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+)
+
+// An OAuth2 authorization server mailboxes can sign in with instead of a
+// password, e.g. Google or Microsoft. Only the token endpoint is needed once a
+// mailbox is enrolled.
+type OAuthProvider struct {
+	Name         string
+	ClientID     string
+	ClientSecret string
+	// For the authorization code flow
+	AuthURL string
+	// For the device code flow
+	DeviceURL string
+	TokenURL  string
+	Scopes    []string
+	// Extra parameters for AuthURL, e.g. access_type=offline for Google
+	AuthParams map[string]string
+	// "xoauth2" or "oauthbearer". Empty picks what the server supports.
+	Mechanism string
+}
+
+type OAuthToken struct {
+	AccessToken string
+	// Only set if the server issued a new one
+	RefreshToken string
+	Expiry       time.Time
+}
+
+// An error response of the token endpoint, see RFC 6749 section 5.2
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *OAuthError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("oauth2: %s: %s", e.Code, e.Description)
+	}
+	return "oauth2: " + e.Code
+}
+
+// What the user has to do to authorize the device, see RFC 8628
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	// Google calls it verification_url
+	VerificationURL string `json:"verification_url"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+const (
+	oauthTimeout = 30 * time.Second
+	// Access tokens are refreshed a bit before they expire
+	tokenExpiryMargin = time.Minute
+	// RFC 8628 default polling interval and what slow_down adds to it, in
+	// seconds
+	defaultDeviceInterval = 5
+	deviceSlowDown        = 5
+)
+
+var oauthClient = &http.Client{Timeout: oauthTimeout}
+
+// Device polling intervals are in seconds, tests shorten them
+var deviceIntervalUnit = time.Second
+
+func parseOAuthProvider(name string, p *OAuthProvider) error {
+	p.Name = name
+	if p.ClientID == "" {
+		return fmt.Errorf("oauth2 provider %s needs a client_id", name)
+	}
+	for _, u := range []string{p.TokenURL, p.AuthURL, p.DeviceURL} {
+		if u == "" {
+			continue
+		}
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+			return fmt.Errorf("oauth2 provider %s has an invalid URL '%s'", name, u)
+		}
+	}
+	if p.TokenURL == "" {
+		return fmt.Errorf("oauth2 provider %s needs a token_url", name)
+	}
+	switch p.Mechanism {
+	case "", "xoauth2", "oauthbearer":
+	default:
+		return fmt.Errorf("oauth2 provider %s has an unknown mechanism '%s', must be xoauth2 or oauthbearer", name, p.Mechanism)
+	}
+	return nil
+}
+
+// requestToken posts a form to the token endpoint
+func requestToken(ctx context.Context, p *OAuthProvider, form url.Values) (OAuthToken, error) {
+	form.Set("client_id", p.ClientID)
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+
+	var res struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+		OAuthError
+	}
+	if err := postForm(ctx, p.TokenURL, form, &res); err != nil {
+		return OAuthToken{}, err
+	}
+	// Some providers answer errors with 200 OK
+	if res.Code != "" {
+		return OAuthToken{}, &res.OAuthError
+	}
+	if res.AccessToken == "" {
+		return OAuthToken{}, errors.New("oauth2: token response without an access token")
+	}
+
+	token := OAuthToken{AccessToken: res.AccessToken, RefreshToken: res.RefreshToken}
+	if res.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(res.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+// postForm decodes the JSON response into v. Error responses are returned as
+// *OAuthError where the server sent one.
+func postForm(ctx context.Context, endpoint string, form url.Values, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		oauthErr := &OAuthError{}
+		if json.Unmarshal(body, oauthErr) == nil && oauthErr.Code != "" {
+			return oauthErr
+		}
+		return fmt.Errorf("oauth2: %s answered %s", endpoint, resp.Status)
+	}
+	return json.Unmarshal(body, v)
+}
+
+func RefreshOAuthToken(ctx context.Context, p *OAuthProvider, refreshToken string) (OAuthToken, error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+	return requestToken(ctx, p, form)
+}
+
+// NewPKCE returns a code verifier and its S256 challenge, see RFC 7636
+func NewPKCE() (string, string, error) {
+	verifier, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// NewOAuthState returns a value that ties the redirect back to the request
+func NewOAuthState() (string, error) {
+	return randomString(16)
+}
+
+func randomString(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// OAuthAuthURL is where the user signs in for the authorization code flow
+func OAuthAuthURL(p *OAuthProvider, redirectURI string, state string, challenge string) string {
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", redirectURI)
+	q.Set("scope", strings.Join(p.Scopes, " "))
+	q.Set("state", state)
+	q.Set("code_challenge", challenge)
+	q.Set("code_challenge_method", "S256")
+	for k, v := range p.AuthParams {
+		q.Set(k, v)
+	}
+
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+	return p.AuthURL + sep + q.Encode()
+}
+
+func ExchangeOAuthCode(ctx context.Context, p *OAuthProvider, code string, redirectURI string, verifier string) (OAuthToken, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("code_verifier", verifier)
+	return requestToken(ctx, p, form)
+}
+
+func StartDeviceAuthorization(ctx context.Context, p *OAuthProvider) (DeviceAuthorization, error) {
+	auth := DeviceAuthorization{}
+	if p.DeviceURL == "" {
+		return auth, fmt.Errorf("oauth2 provider %s has no device_url", p.Name)
+	}
+	form := url.Values{}
+	form.Set("client_id", p.ClientID)
+	form.Set("scope", strings.Join(p.Scopes, " "))
+	if err := postForm(ctx, p.DeviceURL, form, &auth); err != nil {
+		return auth, err
+	}
+	if auth.VerificationURI == "" {
+		auth.VerificationURI = auth.VerificationURL
+	}
+	if auth.DeviceCode == "" || auth.UserCode == "" || auth.VerificationURI == "" {
+		return auth, errors.New("oauth2: incomplete device authorization response")
+	}
+	return auth, nil
+}
+
+// PollDeviceToken waits until the user authorized the device, denied it or
+// the device code expired. auth.Interval is raised whenever the server asks
+// to slow down.
+func PollDeviceToken(ctx context.Context, p *OAuthProvider, auth *DeviceAuthorization) (OAuthToken, error) {
+	if auth.Interval <= 0 {
+		auth.Interval = defaultDeviceInterval
+	}
+	if auth.ExpiresIn > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(auth.ExpiresIn)*time.Second)
+		defer cancel()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return OAuthToken{}, ctx.Err()
+		case <-time.After(time.Duration(auth.Interval) * deviceIntervalUnit):
+		}
+
+		form := url.Values{}
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:device_code")
+		form.Set("device_code", auth.DeviceCode)
+		token, err := requestToken(ctx, p, form)
+
+		var oauthErr *OAuthError
+		if errors.As(err, &oauthErr) {
+			switch oauthErr.Code {
+			case "authorization_pending":
+				continue
+			case "slow_down":
+				auth.Interval += deviceSlowDown
+				continue
+			}
+		}
+		return token, err
+	}
+}
+
+// The XOAUTH2 mechanism of Google and Microsoft, which go-sasl doesn't have
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2Client) Start() (string, []byte, error) {
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// Next answers the JSON error the server sends before failing with an empty
+// response, as required
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
+
+// oauthBearerClient answers the JSON error of the server with the dummy
+// response RFC 7628 asks for. go-sasl cancels the exchange instead, which
+// servers wait out.
+type oauthBearerClient struct {
+	sasl.Client
+	err error
+}
+
+func (a *oauthBearerClient) Next(challenge []byte) ([]byte, error) {
+	if _, err := a.Client.Next(challenge); err != nil {
+		a.err = err
+	}
+	return []byte{0x01}, nil
+}
+
+// accessToken returns the cached access token, or a new one if it is about
+// to expire. Rotated refresh tokens are saved right away.
+func (ctx *MailboxContext) accessToken(p *OAuthProvider) (string, bool, error) {
+	ctx.rwMtx.RLock()
+	token := ctx.token
+	refreshToken := ctx.mailbox.RefreshToken
+	ctx.rwMtx.RUnlock()
+	if token.AccessToken != "" && (token.Expiry.IsZero() || time.Until(token.Expiry) > tokenExpiryMargin) {
+		return token.AccessToken, false, nil
+	}
+
+	reqCtx, cancel := context.WithTimeout(context.Background(), oauthTimeout)
+	defer cancel()
+	token, err := RefreshOAuthToken(reqCtx, p, refreshToken)
+	if err != nil {
+		var oauthErr *OAuthError
+		if errors.As(err, &oauthErr) && (oauthErr.Code == "invalid_grant" || oauthErr.Code == "invalid_client" || oauthErr.Code == "unauthorized_client") {
+			// Refreshing again won't help, the mailbox has to be enrolled again
+			return "", false, &permanentError{err}
+		}
+		return "", false, err
+	}
+
+	if token.RefreshToken != "" && token.RefreshToken != refreshToken {
+		if err := ctx.repo.SaveRefreshToken(ctx.mailbox.Email, token.RefreshToken); err != nil {
+			log.Println(err)
+		}
+	}
+	ctx.rwMtx.Lock()
+	if token.RefreshToken != "" {
+		ctx.mailbox.RefreshToken = token.RefreshToken
+	}
+	ctx.token = token
+	ctx.rwMtx.Unlock()
+	return token.AccessToken, true, nil
+}
+
+func (ctx *MailboxContext) forgetAccessToken() {
+	ctx.rwMtx.Lock()
+	ctx.token = OAuthToken{}
+	ctx.rwMtx.Unlock()
+}
+
+// authenticateOAuth signs in with an access token. A cached token the server
+// rejects may have been revoked early, so it is refreshed and tried once more.
+// The token endpoint failing is only permanent if the refresh token is, the
+// server refusing the token is classified by the caller.
+func authenticateOAuth(ctx *MailboxContext, c *client.Client, config *Configuration) error {
+	p, ok := config.OAuthProviders[ctx.mailbox.OAuthProvider]
+	if !ok {
+		return &permanentError{fmt.Errorf("unknown oauth2 provider '%s'", ctx.mailbox.OAuthProvider)}
+	}
+
+	mech := strings.ToUpper(p.Mechanism)
+	if mech == "" {
+		mech = "XOAUTH2"
+		if bearer, err := c.SupportAuth(sasl.OAuthBearer); err != nil {
+			return err
+		} else if bearer {
+			mech = sasl.OAuthBearer
+		}
+	}
+
+	for {
+		token, fresh, err := ctx.accessToken(p)
+		if err != nil {
+			return err
+		}
+
+		var auth sasl.Client = &xoauth2Client{username: ctx.mailbox.Email, token: token}
+		bearer := &oauthBearerClient{Client: sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: ctx.mailbox.Email,
+			Token:    token,
+			Host:     ctx.mailbox.Server,
+			Port:     int(ctx.mailbox.Port),
+		})}
+		if mech == sasl.OAuthBearer {
+			auth = bearer
+		}
+
+		err = c.Authenticate(auth)
+		if err == nil {
+			return nil
+		}
+		if bearer.err != nil && !strings.Contains(err.Error(), bearer.err.Error()) {
+			// Says more than the server's NO
+			err = fmt.Errorf("%w: %v", err, bearer.err)
+		}
+		if fresh || isNetworkError(err) {
+			return err
+		}
+		ctx.forgetAccessToken()
+	}
+}
@@ -0,0 +1,197 @@
+package mailwatcher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tokenEndpoint answers refresh_token grants and rotates the refresh token on
+// every refresh
+type tokenEndpoint struct {
+	mu        sync.Mutex
+	refresh   string
+	refreshes int
+}
+
+func (te *tokenEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("client_id") != "client" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"invalid_request"}`)
+		return
+	}
+	if r.Form.Get("refresh_token") != te.refresh {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`)
+		return
+	}
+	te.refreshes++
+	te.refresh = fmt.Sprintf("refresh-%d", te.refreshes+1)
+	fmt.Fprintf(w, `{"access_token":"access-%d","refresh_token":%q,"expires_in":3600}`, te.refreshes, te.refresh)
+}
+
+func newOAuthContext(t *testing.T, refreshToken string) *MailboxContext {
+	repo, err := OpenRepository(filepath.Join(t.TempDir(), "emails.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	mb := &Mailbox{Email: "user@example.com", Server: "imap.example.com", Port: 993, OAuthProvider: "test", RefreshToken: refreshToken}
+	if err := repo.AddMailbox(mb); err != nil {
+		t.Fatal(err)
+	}
+	return &MailboxContext{mailbox: mb, repo: &repo}
+}
+
+func TestAccessTokenRefreshesAndSavesRotatedToken(t *testing.T) {
+	te := &tokenEndpoint{refresh: "refresh-1"}
+	srv := httptest.NewServer(te)
+	defer srv.Close()
+	p := &OAuthProvider{Name: "test", ClientID: "client", TokenURL: srv.URL}
+	ctx := newOAuthContext(t, "refresh-1")
+
+	token, fresh, err := ctx.accessToken(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "access-1" || !fresh {
+		t.Errorf("got token %q, fresh %t, want access-1, true", token, fresh)
+	}
+
+	stored, err := ctx.repo.GetMailbox("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.RefreshToken != "refresh-2" {
+		t.Errorf("stored refresh token is %q, want the rotated refresh-2", stored.RefreshToken)
+	}
+
+	// The cached token is used until it is about to expire
+	token, fresh, err = ctx.accessToken(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "access-1" || fresh || te.refreshes != 1 {
+		t.Errorf("got token %q, fresh %t after %d refreshes, want the cached access-1", token, fresh, te.refreshes)
+	}
+
+	// Refreshing again uses the rotated token
+	ctx.forgetAccessToken()
+	if token, _, err = ctx.accessToken(p); err != nil {
+		t.Fatal(err)
+	}
+	if token != "access-2" {
+		t.Errorf("got token %q, want access-2", token)
+	}
+}
+
+func TestAccessTokenInvalidGrantIsPermanent(t *testing.T) {
+	srv := httptest.NewServer(&tokenEndpoint{refresh: "refresh-1"})
+	defer srv.Close()
+	p := &OAuthProvider{Name: "test", ClientID: "client", TokenURL: srv.URL}
+	ctx := newOAuthContext(t, "revoked")
+
+	_, _, err := ctx.accessToken(p)
+	if err == nil {
+		t.Fatal("expected an error for a revoked refresh token")
+	}
+	if !isPermanent(err) {
+		t.Errorf("invalid_grant should be permanent, got %v", err)
+	}
+}
+
+func TestAccessTokenEndpointDownIsTransient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	p := &OAuthProvider{Name: "test", ClientID: "client", TokenURL: srv.URL}
+	ctx := newOAuthContext(t, "refresh-1")
+
+	_, _, err := ctx.accessToken(p)
+	if err == nil {
+		t.Fatal("expected an error while the token endpoint is down")
+	}
+	if isPermanent(err) {
+		t.Errorf("the token endpoint being down should be retried, got a permanent %v", err)
+	}
+}
+
+// shortenDeviceIntervals makes a second of device polling last a millisecond
+func shortenDeviceIntervals(t *testing.T) {
+	deviceIntervalUnit = time.Millisecond
+	t.Cleanup(func() { deviceIntervalUnit = time.Second })
+}
+
+func TestPollDeviceTokenWaitsForAuthorization(t *testing.T) {
+	shortenDeviceIntervals(t)
+	var mu sync.Mutex
+	polls := 0
+	answers := []string{`{"error":"authorization_pending"}`, `{"error":"slow_down"}`}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:device_code" || r.Form.Get("device_code") != "device" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_request"}`)
+			return
+		}
+		polls++
+		if polls <= len(answers) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, answers[polls-1])
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"access","refresh_token":"refresh","expires_in":3600}`)
+	}))
+	defer srv.Close()
+	p := &OAuthProvider{Name: "test", ClientID: "client", TokenURL: srv.URL}
+
+	auth := &DeviceAuthorization{DeviceCode: "device", Interval: 1, ExpiresIn: 60}
+	token, err := PollDeviceToken(context.Background(), p, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.RefreshToken != "refresh" {
+		t.Errorf("got refresh token %q, want refresh", token.RefreshToken)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if polls != 3 {
+		t.Fatalf("polled %d times, want 3", polls)
+	}
+	if auth.Interval != 1+deviceSlowDown {
+		t.Errorf("interval is %d after slow_down, want %d", auth.Interval, 1+deviceSlowDown)
+	}
+}
+
+func TestPollDeviceTokenStopsOnDenial(t *testing.T) {
+	shortenDeviceIntervals(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"access_denied"}`)
+	}))
+	defer srv.Close()
+	p := &OAuthProvider{Name: "test", ClientID: "client", TokenURL: srv.URL}
+
+	auth := &DeviceAuthorization{DeviceCode: "device", Interval: 1, ExpiresIn: 60}
+	_, err := PollDeviceToken(context.Background(), p, auth)
+	oauthErr, ok := err.(*OAuthError)
+	if !ok || oauthErr.Code != "access_denied" {
+		t.Errorf("got %v, want access_denied", err)
+	}
+}
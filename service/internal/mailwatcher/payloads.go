@@ -0,0 +1,495 @@
+package mailwatcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Every request payload validates itself after decoding and reports the
+// problems per field so clients can show them next to the right input.
+type Validator interface {
+	Validate() []FieldError
+}
+
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+type HelloRequest struct {
+	Version int `json:"version"`
+}
+
+func (r *HelloRequest) Validate() []FieldError {
+	if r.Version <= 0 {
+		return []FieldError{{Field: "version", Message: "must be a positive protocol version"}}
+	}
+	return nil
+}
+
+type HelloReply struct {
+	Version int      `json:"version"`
+	Actions []string `json:"actions"`
+	Events  []string `json:"events"`
+}
+
+// Params for actions that don't take any
+type EmptyRequest struct{}
+
+func (r *EmptyRequest) Validate() []FieldError {
+	return nil
+}
+
+// Params for Remove, Watch, Stop and GetMailbox
+type MailboxRequest struct {
+	Email string `json:"email"`
+}
+
+func (r *MailboxRequest) Validate() []FieldError {
+	return validateEmail(nil, r.Email)
+}
+
+// How a mailbox's connection is secured, see TLSOptions. The mode defaults to
+// implicit.
+type TLSSettings struct {
+	Mode       string   `json:"mode,omitempty"`
+	CAFile     string   `json:"caFile,omitempty"`
+	Pins       []string `json:"pins,omitempty"`
+	MinVersion string   `json:"minVersion,omitempty"`
+	ClientCert string   `json:"clientCert,omitempty"`
+	ClientKey  string   `json:"clientKey,omitempty"`
+}
+
+func (t *TLSSettings) validate(errs []FieldError) []FieldError {
+	if _, err := ParseTLSMode(t.Mode); err != nil {
+		errs = append(errs, FieldError{Field: "tls.mode", Message: err.Error()})
+	}
+	if _, err := ParseTLSVersion(t.MinVersion); err != nil {
+		errs = append(errs, FieldError{Field: "tls.minVersion", Message: err.Error()})
+	}
+	for _, pin := range t.Pins {
+		if _, err := ParseTLSPin(pin); err != nil {
+			errs = append(errs, FieldError{Field: "tls.pins", Message: err.Error()})
+			break
+		}
+	}
+	if t.ClientKey != "" && t.ClientCert == "" {
+		errs = append(errs, FieldError{Field: "tls.clientKey", Message: "needs a client certificate"})
+	}
+	return errs
+}
+
+// Only valid settings can be turned into options
+func (t *TLSSettings) options() TLSOptions {
+	mode, _ := ParseTLSMode(t.Mode)
+	minVersion, _ := ParseTLSVersion(t.MinVersion)
+	var pins []string
+	for _, p := range t.Pins {
+		pin, _ := ParseTLSPin(p)
+		pins = append(pins, pin)
+	}
+	return TLSOptions{
+		Mode:       mode,
+		CAFile:     t.CAFile,
+		Pins:       pins,
+		MinVersion: minVersion,
+		ClientCert: t.ClientCert,
+		ClientKey:  t.ClientKey,
+	}
+}
+
+func newTLSSettings(opts *TLSOptions) TLSSettings {
+	return TLSSettings{
+		Mode:       opts.Mode.ToString(),
+		CAFile:     opts.CAFile,
+		Pins:       opts.Pins,
+		MinVersion: tlsVersionString(opts.MinVersion),
+		ClientCert: opts.ClientCert,
+		ClientKey:  opts.ClientKey,
+	}
+}
+
+type AddRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Server   string `json:"server"`
+	Port     int    `json:"port"`
+	// Deprecated: use TLS. False is the same as the plaintext mode.
+	UseSSL *bool        `json:"useSSL,omitempty"`
+	TLS    *TLSSettings `json:"tls,omitempty"`
+	// Poll even if the server supports IDLE
+	DisableIdle bool `json:"disableIdle,omitempty"`
+	// Defaults to INBOX. The junk folder is always watched.
+	Folders []string `json:"folders,omitempty"`
+	// Run on emails a code was extracted from, see ParsePostAction
+	Actions []string `json:"actions,omitempty"`
+	// Sign in with OAuth2 instead of the password. The provider must be in the
+	// service's configuration.
+	OAuthProvider string `json:"oauthProvider,omitempty"`
+	RefreshToken  string `json:"refreshToken,omitempty"`
+}
+
+func (r *AddRequest) Validate() []FieldError {
+	errs := validateEmail(nil, r.Email)
+	if r.OAuthProvider == "" && r.Password == "" {
+		errs = append(errs, FieldError{Field: "password", Message: "is required"})
+	}
+	if r.OAuthProvider != "" && r.RefreshToken == "" {
+		errs = append(errs, FieldError{Field: "refreshToken", Message: "is required for oauth2 mailboxes"})
+	}
+	if r.OAuthProvider == "" && r.RefreshToken != "" {
+		errs = append(errs, FieldError{Field: "oauthProvider", Message: "is required with a refresh token"})
+	}
+	if strings.TrimSpace(r.Server) == "" {
+		errs = append(errs, FieldError{Field: "server", Message: "is required"})
+	}
+	if r.TLS != nil {
+		errs = r.TLS.validate(errs)
+		if r.UseSSL != nil && r.TLS.Mode != "" {
+			errs = append(errs, FieldError{Field: "useSSL", Message: "must not be combined with tls.mode"})
+		}
+	}
+	if r.Port <= 0 || r.Port > 65535 {
+		errs = append(errs, FieldError{Field: "port", Message: "must be between 1 and 65535"})
+	}
+	for _, folder := range r.Folders {
+		if strings.TrimSpace(folder) == "" || strings.ContainsAny(folder, "\r\n") {
+			errs = append(errs, FieldError{Field: "folders", Message: "must not contain empty names or line breaks"})
+			break
+		}
+	}
+	if _, err := ParsePostActions(r.Actions); err != nil {
+		errs = append(errs, FieldError{Field: "actions", Message: err.Error()})
+	}
+	return errs
+}
+
+// TLS defaults to the implicit mode, like in the repository. Only valid
+// requests can be turned into mailboxes.
+func (r *AddRequest) Mailbox() Mailbox {
+	tlsOpts := TLSOptions{}
+	if r.TLS != nil {
+		tlsOpts = r.TLS.options()
+	}
+	if r.UseSSL != nil && !*r.UseSSL {
+		tlsOpts.Mode = TLSPlaintext
+	}
+	actions, _ := ParsePostActions(r.Actions)
+	return Mailbox{
+		Email:         r.Email,
+		Password:      r.Password,
+		Server:        r.Server,
+		Port:          int32(r.Port),
+		TLS:           tlsOpts,
+		DisableIdle:   r.DisableIdle,
+		Folders:       r.Folders,
+		Actions:       actions,
+		OAuthProvider: r.OAuthProvider,
+		RefreshToken:  r.RefreshToken,
+	}
+}
+
+// Mailboxes are never sent back with their password or refresh token
+type MailboxInfo struct {
+	Email  string `json:"email"`
+	Server string `json:"server"`
+	Port   int32  `json:"port"`
+	// Deprecated: true if the TLS mode is implicit
+	UseSSL      bool        `json:"useSSL"`
+	TLS         TLSSettings `json:"tls"`
+	DisableIdle bool        `json:"disableIdle"`
+	Folders     []string    `json:"folders,omitempty"`
+	Actions     []string    `json:"actions,omitempty"`
+	// Set for mailboxes that sign in with OAuth2
+	OAuthProvider string `json:"oauthProvider,omitempty"`
+}
+
+func NewMailboxInfo(mb *Mailbox) MailboxInfo {
+	return MailboxInfo{
+		Email:         mb.Email,
+		Server:        mb.Server,
+		Port:          mb.Port,
+		UseSSL:        mb.TLS.Mode == TLSImplicit,
+		TLS:           newTLSSettings(&mb.TLS),
+		DisableIdle:   mb.DisableIdle,
+		Folders:       mb.Folders,
+		Actions:       postActionStrings(mb.Actions),
+		OAuthProvider: mb.OAuthProvider,
+	}
+}
+
+type MailboxList struct {
+	Emails []MailboxInfo `json:"emails"`
+}
+
+// Params for Status. An empty email asks for every mailbox.
+type StatusRequest struct {
+	Email string `json:"email,omitempty"`
+}
+
+func (r *StatusRequest) Validate() []FieldError {
+	if r.Email == "" {
+		return nil
+	}
+	return validateEmail(nil, r.Email)
+}
+
+// Timestamps are left out until the event they track first happens
+type MailboxStatusInfo struct {
+	Email          string     `json:"email"`
+	State          string     `json:"state"`
+	ConnectedSince *time.Time `json:"connectedSince,omitempty"`
+	LastIdle       *time.Time `json:"lastIdle,omitempty"`
+	LastFetch      *time.Time `json:"lastFetch,omitempty"`
+	LastCode       *time.Time `json:"lastCode,omitempty"`
+	LastError      string     `json:"lastError,omitempty"`
+	LastErrorAt    *time.Time `json:"lastErrorAt,omitempty"`
+	Reconnects     int        `json:"reconnects"`
+	NextRetry      *time.Time `json:"nextRetry,omitempty"`
+}
+
+func NewMailboxStatusInfo(st *MailboxStatus) MailboxStatusInfo {
+	return MailboxStatusInfo{
+		Email:          st.Email,
+		State:          st.State.ToString(),
+		ConnectedSince: optionalTime(st.ConnectedSince),
+		LastIdle:       optionalTime(st.LastIdle),
+		LastFetch:      optionalTime(st.LastFetch),
+		LastCode:       optionalTime(st.LastCode),
+		LastError:      st.LastError,
+		LastErrorAt:    optionalTime(st.LastErrorAt),
+		Reconnects:     st.Reconnects,
+		NextRetry:      optionalTime(st.NextRetry),
+	}
+}
+
+type StatusReply struct {
+	Mailboxes []MailboxStatusInfo `json:"mailboxes"`
+}
+
+// Event types a client can subscribe to
+const (
+	CodeEvents  = "codes"
+	LinkEvents  = "links"
+	StateEvents = "state"
+	ErrorEvents = "errors"
+)
+
+// Empty filters match everything. Senders are either full addresses or
+// domains, which also match their subdomains.
+type SubscribeRequest struct {
+	Mailboxes []string `json:"mailboxes,omitempty"`
+	Senders   []string `json:"senders,omitempty"`
+	Events    []string `json:"events,omitempty"`
+}
+
+func (r *SubscribeRequest) Validate() []FieldError {
+	errs := []FieldError{}
+	for _, mb := range r.Mailboxes {
+		if strings.TrimSpace(mb) == "" {
+			errs = append(errs, FieldError{Field: "mailboxes", Message: "must not contain empty entries"})
+			break
+		}
+	}
+	for _, sender := range r.Senders {
+		if strings.Trim(sender, "@ ") == "" {
+			errs = append(errs, FieldError{Field: "senders", Message: "must not contain empty entries"})
+			break
+		}
+	}
+	for _, ev := range r.Events {
+		if ev != CodeEvents && ev != LinkEvents && ev != StateEvents && ev != ErrorEvents {
+			errs = append(errs, FieldError{Field: "events", Message: fmt.Sprintf("unknown event type '%s'", ev)})
+		}
+	}
+	return errs
+}
+
+// The email a code or link was found in, part of CodeEvent and LinkEvent.
+// Stale is set for emails older than the configured max age.
+type EmailInfo struct {
+	Folder      string     `json:"folder"`
+	Uid         uint32     `json:"uid"`
+	MessageID   string     `json:"messageId,omitempty"`
+	Subject     string     `json:"subject"`
+	Date        *time.Time `json:"date,omitempty"`
+	ReceivedAt  *time.Time `json:"receivedAt,omitempty"`
+	ExtractedAt time.Time  `json:"extractedAt"`
+	Stale       bool       `json:"stale,omitempty"`
+}
+
+func newEmailInfo(code *EmailCode) EmailInfo {
+	return EmailInfo{
+		Folder:      code.Folder,
+		Uid:         code.Uid,
+		MessageID:   code.MessageID,
+		Subject:     code.Subject,
+		Date:        optionalTime(code.Date),
+		ReceivedAt:  optionalTime(code.ReceivedAt),
+		ExtractedAt: code.ExtractedAt,
+		Stale:       code.Stale,
+	}
+}
+
+// Replayed is set for codes that were extracted before the client subscribed.
+// Confidence is 1 for codes found by an extractor and lower for guesses.
+type CodeEvent struct {
+	Mailbox    string  `json:"mailbox"`
+	Sender     string  `json:"sender"`
+	Code       string  `json:"code"`
+	Confidence float64 `json:"confidence"`
+	Replayed   bool    `json:"replayed,omitempty"`
+	EmailInfo
+}
+
+func NewCodeEvent(code *EmailCode) CodeEvent {
+	return CodeEvent{
+		Mailbox:    code.Mailbox,
+		Sender:     code.Sender,
+		Code:       code.Code,
+		Confidence: code.Confidence,
+		EmailInfo:  newEmailInfo(code),
+	}
+}
+
+// A verification link to open instead of a code to copy
+type LinkEvent struct {
+	Mailbox  string `json:"mailbox"`
+	Sender   string `json:"sender"`
+	URL      string `json:"url"`
+	Replayed bool   `json:"replayed,omitempty"`
+	EmailInfo
+}
+
+func NewLinkEvent(code *EmailCode) LinkEvent {
+	return LinkEvent{
+		Mailbox:   code.Mailbox,
+		Sender:    code.Sender,
+		URL:       code.Link,
+		EmailInfo: newEmailInfo(code),
+	}
+}
+
+// Params for RecentCodes. The connection's subscription filters apply as well.
+type RecentCodesRequest struct {
+	Mailbox string `json:"mailbox,omitempty"`
+}
+
+func (r *RecentCodesRequest) Validate() []FieldError {
+	if r.Mailbox == "" {
+		return nil
+	}
+	errs := validateEmail(nil, r.Mailbox)
+	for i := range errs {
+		errs[i].Field = "mailbox"
+	}
+	return errs
+}
+
+// Codes and links that haven't expired yet, oldest first
+type RecentCodesReply struct {
+	Codes []CodeEvent `json:"codes"`
+	Links []LinkEvent `json:"links"`
+}
+
+// Sent as StateChanged and ConnectionError events
+type MailboxStateEvent struct {
+	Mailbox   string     `json:"mailbox"`
+	State     string     `json:"state"`
+	Error     string     `json:"error,omitempty"`
+	NextRetry *time.Time `json:"nextRetry,omitempty"`
+	Time      time.Time  `json:"time"`
+}
+
+func NewMailboxStateEvent(ev *MailboxEvent) MailboxStateEvent {
+	return MailboxStateEvent{
+		Mailbox:   ev.Mailbox,
+		State:     ev.State.ToString(),
+		Error:     ev.Error,
+		NextRetry: optionalTime(ev.NextRetry),
+		Time:      ev.Time,
+	}
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func validateEmail(errs []FieldError, email string) []FieldError {
+	if email == "" {
+		return append(errs, FieldError{Field: "email", Message: "is required"})
+	}
+	if _, err := mail.ParseAddress(email); err != nil {
+		return append(errs, FieldError{Field: "email", Message: "is not a valid email address"})
+	}
+	return errs
+}
+
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Ptr:
+		return jsonTypeName(t.Elem())
+	default:
+		return "object"
+	}
+}
+
+func encodeParams(params interface{}) (json.RawMessage, error) {
+	if params == nil {
+		return nil, nil
+	}
+	return json.Marshal(params)
+}
+
+// UnmarshalParams decodes the params of a reply or event without validating them.
+func UnmarshalParams(msg *Message, v interface{}) error {
+	if len(msg.Params) == 0 {
+		return nil
+	}
+	return json.Unmarshal(msg.Params, v)
+}
+
+// DecodeRequest decodes and validates the params of a request. The returned
+// error is always an *Error that can be sent back to the client as is.
+func DecodeRequest(msg *Message, v Validator) error {
+	params := msg.Params
+	if len(bytes.TrimSpace(params)) == 0 || bytes.Equal(bytes.TrimSpace(params), []byte("null")) {
+		params = json.RawMessage("{}")
+	}
+
+	if err := json.Unmarshal(params, v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			e := NewError(ErrInvalidParams, "invalid params")
+			e.Fields = []FieldError{{Field: typeErr.Field, Message: fmt.Sprintf("must be of type %s", jsonTypeName(typeErr.Type))}}
+			return e
+		}
+		return NewError(ErrInvalidParams, "invalid params: %s", err)
+	}
+
+	if fields := v.Validate(); len(fields) > 0 {
+		e := NewError(ErrInvalidParams, "invalid params")
+		e.Fields = fields
+		return e
+	}
+	return nil
+}
@@ -1,10 +1,22 @@
 package mailwatcher
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 )
 
+// Messages on the control socket are framed as a 4 byte big endian payload
+// length followed by the JSON encoded message.
+const (
+	frameHeaderSize = 4
+	MaxFrameSize    = 1 << 20
+)
+
+var ErrFrameTooLarge = errors.New("frame exceeds maximum size")
+
 type Action int32
 
 const (
@@ -18,11 +30,140 @@ const (
 	GetMailbox      Action = 8
 	GetAllMailboxes Action = 9
 	ConnectionError Action = 10
+	Hello           Action = 11
+	Subscribe       Action = 12
+	StateChanged    Action = 13
+	Status          Action = 14
+	RecentCodes     Action = 15
+	Link            Action = 16
+)
+
+// ProtocolVersion is bumped whenever an existing action changes in a way old
+// clients can't handle. New actions are advertised in the Hello reply instead.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// Actions a client may send, in the order they are advertised
+var requestActions = []Action{
+	Hello,
+	Add,
+	Remove,
+	Watch,
+	WatchAll,
+	Stop,
+	StopAll,
+	GetMailbox,
+	GetAllMailboxes,
+	Subscribe,
+	Status,
+	RecentCodes,
+}
+
+// Actions the service sends as events
+var eventActions = []Action{
+	Code,
+	ConnectionError,
+	StateChanged,
+	Link,
+}
+
+// Requests are sent by clients, replies answer a request with the same ID on
+// the same connection and events are sent unsolicited by the service.
+type MessageType int32
+
+const (
+	Request MessageType = 0
+	Reply   MessageType = 1
+	Event   MessageType = 2
 )
 
+type ErrorCode string
+
+const (
+	ErrInvalidMessage ErrorCode = "invalid_message"
+	ErrInvalidAction  ErrorCode = "invalid_action"
+	ErrInvalidParams  ErrorCode = "invalid_params"
+	ErrNotFound       ErrorCode = "not_found"
+	ErrInternal       ErrorCode = "internal"
+
+	ErrHandshakeRequired  ErrorCode = "handshake_required"
+	ErrUnsupportedVersion ErrorCode = "unsupported_version"
+)
+
+type Error struct {
+	Code    ErrorCode
+	Message string
+	Fields  []FieldError `json:",omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func NewError(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
 type Message struct {
+	ID     string `json:",omitempty"`
+	Type   MessageType
 	Cmd    Action
-	Params map[string]interface{}
+	Params json.RawMessage `json:",omitempty"`
+	Error  *Error          `json:",omitempty"`
+}
+
+func NewRequest(id string, cmd Action, params interface{}) (Message, error) {
+	p, err := encodeParams(params)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		ID:     id,
+		Type:   Request,
+		Cmd:    cmd,
+		Params: p,
+	}, nil
+}
+
+func NewReply(req *Message, params interface{}) Message {
+	p, err := encodeParams(params)
+	if err != nil {
+		return NewErrorReply(req, err)
+	}
+	return Message{
+		ID:     req.ID,
+		Type:   Reply,
+		Cmd:    req.Cmd,
+		Params: p,
+	}
+}
+
+// NewErrorReply wraps errors that are not already an *Error as internal errors.
+func NewErrorReply(req *Message, err error) Message {
+	var e *Error
+	if !errors.As(err, &e) {
+		e = &Error{Code: ErrInternal, Message: err.Error()}
+	}
+	return Message{
+		ID:    req.ID,
+		Type:  Reply,
+		Cmd:   req.Cmd,
+		Error: e,
+	}
+}
+
+func NewEvent(cmd Action, params interface{}) (Message, error) {
+	p, err := encodeParams(params)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Type:   Event,
+		Cmd:    cmd,
+		Params: p,
+	}, nil
 }
 
 func (a *Action) ToString() (string, error) {
@@ -47,11 +188,47 @@ func (a *Action) ToString() (string, error) {
 		return "GetMailbox", nil
 	case GetAllMailboxes:
 		return "GetAllMailboxes", nil
+	case Hello:
+		return "Hello", nil
+	case Subscribe:
+		return "Subscribe", nil
+	case StateChanged:
+		return "StateChanged", nil
+	case Status:
+		return "Status", nil
+	case RecentCodes:
+		return "RecentCodes", nil
+	case Link:
+		return "Link", nil
 	default:
 		return "", errors.New("unknown message action")
 	}
 }
 
+func actionNames(actions []Action) []string {
+	names := make([]string, 0, len(actions))
+	for _, a := range actions {
+		name, err := a.ToString()
+		if err != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func SupportedActions() []string {
+	return actionNames(requestActions)
+}
+
+func SupportedEvents() []string {
+	return actionNames(eventActions)
+}
+
+func IsSupportedVersion(version int) bool {
+	return version >= MinProtocolVersion && version <= ProtocolVersion
+}
+
 func Parse(msg []byte) (Message, error) {
 	m := Message{}
 	err := json.Unmarshal(msg, &m)
@@ -64,3 +241,52 @@ func Parse(msg []byte) (Message, error) {
 func Serialize(msg *Message) ([]byte, error) {
 	return json.Marshal(*msg)
 }
+
+func Frame(msg *Message) ([]byte, error) {
+	payload, err := Serialize(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+	return frame, nil
+}
+
+// WriteMessage sends the whole frame in a single Write so that frames written
+// to the same connection from different goroutines never interleave.
+func WriteMessage(w io.Writer, msg *Message) error {
+	frame, err := Frame(msg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(frame)
+	return err
+}
+
+// ReadMessage blocks until a full frame has been read from r. It returns
+// io.EOF only if the stream ended cleanly between two frames.
+func ReadMessage(r io.Reader) (Message, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Message{}, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > MaxFrameSize {
+		return Message{}, ErrFrameTooLarge
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return Message{}, err
+	}
+	return Parse(payload)
+}
@@ -0,0 +1,183 @@
+package mailwatcher
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+const (
+	defaultMinReconnectDelay = 2 * time.Second
+	defaultMaxReconnectDelay = 5 * time.Minute
+	// Sessions that stayed up for this long start over with the shortest delay
+	stableSessionDuration = time.Minute
+)
+
+// Errors that won't go away by reconnecting, like rejected credentials.
+// Watching stops until the mailbox is watched again.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func isPermanent(err error) bool {
+	var perm *permanentError
+	return errors.As(err, &perm)
+}
+
+// isNetworkError reports whether err was caused by the connection rather than
+// by the server's answer to a command.
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	// go-imap doesn't wrap this one
+	return strings.Contains(err.Error(), "connection closed")
+}
+
+// Response codes of logins that fail the same way however often they are
+// retried, see RFC 5530
+var permanentLoginCodes = []string{"AUTHENTICATIONFAILED", "AUTHORIZATIONFAILED", "EXPIRED"}
+
+// classifyLoginError only treats rejected credentials as permanent. Other
+// refusals, like [UNAVAILABLE], [INUSE] or too many simultaneous connections,
+// go away by themselves and are retried. code is the response code of the
+// refusal, if the server sent one.
+func classifyLoginError(err error, code string) error {
+	if isNetworkError(err) {
+		return err
+	}
+	if errors.Is(err, client.ErrLoginDisabled) {
+		return &permanentError{err}
+	}
+	if code == "" {
+		return err
+	}
+	err = fmt.Errorf("[%s] %w", code, err)
+	if slices.Contains(permanentLoginCodes, code) {
+		return &permanentError{err}
+	}
+	return err
+}
+
+// Longer lines are server responses a response code isn't looked for in
+const maxStatusLine = 1024
+
+// statusCodes picks the response code out of the server's answers to a login,
+// which go-imap leaves out of its errors. It only sees what the server sends,
+// and ignores everything once the login is over.
+type statusCodes struct {
+	mu    sync.Mutex
+	armed bool
+	line  []byte
+	code  string
+}
+
+func (s *statusCodes) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.armed {
+		return len(p), nil
+	}
+	for _, b := range p {
+		if b != '\n' {
+			if len(s.line) < maxStatusLine {
+				s.line = append(s.line, b)
+			}
+			continue
+		}
+		if code, ok := parseStatusCode(string(s.line)); ok {
+			s.code = code
+		}
+		s.line = s.line[:0]
+	}
+	return len(p), nil
+}
+
+// arm starts looking for the code of the next refusal
+func (s *statusCodes) arm() {
+	s.mu.Lock()
+	s.armed, s.line, s.code = true, s.line[:0], ""
+	s.mu.Unlock()
+}
+
+// take stops looking and returns the code of the last refusal
+func (s *statusCodes) take() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.armed = false
+	return s.code
+}
+
+// parseStatusCode returns the code of tagged NO and BAD responses, like
+// AUTHENTICATIONFAILED in "a1 NO [AUTHENTICATIONFAILED] Invalid credentials"
+func parseStatusCode(line string) (string, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[0] == "*" || fields[0] == "+" {
+		return "", false
+	}
+	if status := strings.ToUpper(fields[1]); status != "NO" && status != "BAD" {
+		return "", false
+	}
+	if !strings.HasPrefix(fields[2], "[") {
+		return "", true
+	}
+	code, _, _ := strings.Cut(strings.TrimPrefix(fields[2], "["), "]")
+	return strings.ToUpper(code), true
+}
+
+// backoff computes jittered, exponentially growing delays between reconnect
+// attempts, capped at max.
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt int
+}
+
+func newBackoff(config *Configuration) *backoff {
+	b := &backoff{
+		min: config.MinReconnectDelay,
+		max: config.MaxReconnectDelay,
+	}
+	if b.min <= 0 {
+		b.min = defaultMinReconnectDelay
+	}
+	if b.max < b.min {
+		b.max = max(b.min, defaultMaxReconnectDelay)
+	}
+	return b
+}
+
+func (b *backoff) next() time.Duration {
+	delay := b.min
+	for i := 0; i < b.attempt && delay < b.max; i++ {
+		delay *= 2
+	}
+	delay = min(delay, b.max)
+	b.attempt++
+
+	// Anywhere between half and the full delay, so that mailboxes on the same
+	// server don't all reconnect at once
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
@@ -8,6 +8,8 @@ import (
 	"log"
 	"os"
 	"path"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -21,7 +23,89 @@ type Mailbox struct {
 	Password string
 	Server   string
 	Port     int32
-	UseSSL   bool
+	TLS      TLSOptions
+	// Poll even if the server supports IDLE
+	DisableIdle bool
+	// Folders to watch besides the junk folder. Empty means only INBOX.
+	Folders []string
+	// Run on emails a code was extracted from. Empty leaves them untouched.
+	Actions []PostAction
+	// Signs in with OAuth2 instead of the password if set. Names a provider of
+	// the configuration.
+	OAuthProvider string
+	RefreshToken  string
+}
+
+// Each migration upgrades the schema by one version. The number of applied
+// migrations is kept in the database's user_version.
+var migrations = []string{
+	`ALTER TABLE mailboxes ADD COLUMN disable_idle BOOLEAN NOT NULL DEFAULT FALSE;`,
+	`ALTER TABLE mailboxes ADD COLUMN folders TEXT NOT NULL DEFAULT '';`,
+	`CREATE TABLE folder_progress (
+		email TEXT NOT NULL,
+		folder TEXT NOT NULL,
+		uid_validity INTEGER NOT NULL,
+		last_uid INTEGER NOT NULL,
+		PRIMARY KEY (email, folder)
+	);`,
+	`ALTER TABLE mailboxes ADD COLUMN actions TEXT NOT NULL DEFAULT '';`,
+	`CREATE TABLE seen_codes (
+		key TEXT PRIMARY KEY,
+		seen_at INTEGER NOT NULL
+	);`,
+	`ALTER TABLE mailboxes ADD COLUMN oauth_provider TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE mailboxes ADD COLUMN refresh_token TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE mailboxes ADD COLUMN tls_mode TEXT NOT NULL DEFAULT 'implicit';`,
+	`UPDATE mailboxes SET tls_mode = 'plaintext' WHERE NOT usessl;`,
+	`ALTER TABLE mailboxes ADD COLUMN tls_ca_file TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE mailboxes ADD COLUMN tls_pins TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE mailboxes ADD COLUMN tls_min_version TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE mailboxes ADD COLUMN tls_client_cert TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE mailboxes ADD COLUMN tls_client_key TEXT NOT NULL DEFAULT '';`,
+	`CREATE TABLE pending_deletions (
+		email TEXT NOT NULL,
+		folder TEXT NOT NULL,
+		uid_validity INTEGER NOT NULL,
+		uid INTEGER NOT NULL,
+		due INTEGER NOT NULL,
+		PRIMARY KEY (email, folder, uid_validity, uid)
+	);`,
+}
+
+// Where processing of a folder left off. UIDs only identify the same
+// messages as long as the folder's UIDVALIDITY doesn't change.
+type FolderProgress struct {
+	Email       string
+	Folder      string
+	UidValidity uint32
+	LastUid     uint32
+}
+
+// An email waiting to be deleted once its action's delay is over
+type PendingDeletion struct {
+	Email       string
+	Folder      string
+	UidValidity uint32
+	Uid         uint32
+	Due         time.Time
+}
+
+// A code event that was already sent. The key identifies the email and the
+// code without containing either.
+type SeenCode struct {
+	Key    string
+	SeenAt time.Time
+}
+
+// The usessl column was replaced by tls_mode and is no longer used
+const mailboxColumns = "email, password, server, port, tls_mode, disable_idle, folders, actions, oauth_provider, refresh_token, " +
+	"tls_ca_file, tls_pins, tls_min_version, tls_client_cert, tls_client_key"
+
+// Folder names, actions and pins are stored one per line
+const folderSeparator = "\n"
+
+type scanner interface {
+	Scan(dest ...any) error
 }
 
 func DefaultRepoPath() string {
@@ -57,16 +141,71 @@ func OpenRepository(dbPath string) (Repository, error) {
 		return repo, err
 	}
 
+	if err = migrate(con); err != nil {
+		return repo, err
+	}
+
 	repo.conn = con
 	return repo, nil
 }
 
+func migrate(con *sql.DB) error {
+	var version int
+	if err := con.QueryRow("PRAGMA user_version;").Scan(&version); err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := con.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(migrations[version]); err == nil {
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d;", version+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrating database to version %d: %w", version+1, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanMailbox(row scanner) (Mailbox, error) {
+	m := Mailbox{}
+	folders, actions, tlsMode, pins, minVersion := "", "", "", "", ""
+	err := row.Scan(&(m.Email), &(m.Password), &(m.Server), &(m.Port), &tlsMode, &(m.DisableIdle), &folders, &actions, &(m.OAuthProvider), &(m.RefreshToken),
+		&(m.TLS.CAFile), &pins, &minVersion, &(m.TLS.ClientCert), &(m.TLS.ClientKey))
+	if err != nil {
+		return m, err
+	}
+	if m.TLS.Mode, err = ParseTLSMode(tlsMode); err != nil {
+		return m, err
+	}
+	if m.TLS.MinVersion, err = ParseTLSVersion(minVersion); err != nil {
+		return m, err
+	}
+	if pins != "" {
+		m.TLS.Pins = strings.Split(pins, folderSeparator)
+	}
+	if folders != "" {
+		m.Folders = strings.Split(folders, folderSeparator)
+	}
+	if actions != "" {
+		m.Actions, err = ParsePostActions(strings.Split(actions, folderSeparator))
+	}
+	return m, err
+}
+
 func (rep *Repository) Close() error {
 	return rep.conn.Close()
 }
 
 func (rep *Repository) GetAllMailboxes() (*list.List, error) {
-	var getMailbox = "SELECT email, password, server, port, usessl FROM mailboxes;"
+	var getMailbox = "SELECT " + mailboxColumns + " FROM mailboxes;"
 	rows, err := rep.conn.Query(getMailbox)
 	if err != nil {
 		return list.New(), err
@@ -76,8 +215,7 @@ func (rep *Repository) GetAllMailboxes() (*list.List, error) {
 
 	mailboxes := list.New()
 	for rows.Next() {
-		m := Mailbox{}
-		err := rows.Scan(&(m.Email), &(m.Password), &(m.Server), &(m.Port), &(m.UseSSL))
+		m, err := scanMailbox(rows)
 		if err != nil {
 			return list.New(), err
 		}
@@ -89,14 +227,33 @@ func (rep *Repository) GetAllMailboxes() (*list.List, error) {
 }
 
 func (rep *Repository) AddMailbox(m *Mailbox) error {
-	var insertMailbox = `INSERT INTO mailboxes VALUES 
-	(:email, :password, :server, :port, :useSSL);`
+	var insertMailbox = `INSERT INTO mailboxes (` + mailboxColumns + `) VALUES 
+	(:email, :password, :server, :port, :tlsMode, :disableIdle, :folders, :actions, :oauthProvider, :refreshToken,
+	:caFile, :pins, :minVersion, :clientCert, :clientKey);`
 	_, err := rep.conn.Exec(insertMailbox,
 		sql.Named("email", m.Email),
 		sql.Named("password", m.Password),
 		sql.Named("server", m.Server),
 		sql.Named("port", m.Port),
-		sql.Named("useSSL", m.UseSSL))
+		sql.Named("tlsMode", m.TLS.Mode.ToString()),
+		sql.Named("disableIdle", m.DisableIdle),
+		sql.Named("folders", strings.Join(m.Folders, folderSeparator)),
+		sql.Named("actions", strings.Join(postActionStrings(m.Actions), folderSeparator)),
+		sql.Named("oauthProvider", m.OAuthProvider),
+		sql.Named("refreshToken", m.RefreshToken),
+		sql.Named("caFile", m.TLS.CAFile),
+		sql.Named("pins", strings.Join(m.TLS.Pins, folderSeparator)),
+		sql.Named("minVersion", tlsVersionString(m.TLS.MinVersion)),
+		sql.Named("clientCert", m.TLS.ClientCert),
+		sql.Named("clientKey", m.TLS.ClientKey))
+	return err
+}
+
+// SaveRefreshToken replaces the refresh token of an OAuth2 mailbox, e.g. after
+// the provider rotated it
+func (rep *Repository) SaveRefreshToken(email string, token string) error {
+	var saveToken = `UPDATE mailboxes SET refresh_token=:refreshToken WHERE email=:email;`
+	_, err := rep.conn.Exec(saveToken, sql.Named("refreshToken", token), sql.Named("email", email))
 	return err
 }
 
@@ -104,15 +261,160 @@ func (rep *Repository) RemoveMailbox(email string) error {
 	var deleteMailbox = `DELETE FROM mailboxes WHERE
 	email=:email;`
 	_, err := rep.conn.Exec(deleteMailbox, email)
+	if err != nil {
+		return err
+	}
+
+	var deleteProgress = `DELETE FROM folder_progress WHERE
+	email=:email;`
+	_, err = rep.conn.Exec(deleteProgress, sql.Named("email", email))
+	if err != nil {
+		return err
+	}
+
+	var deleteDeletions = `DELETE FROM pending_deletions WHERE
+	email=:email;`
+	_, err = rep.conn.Exec(deleteDeletions, sql.Named("email", email))
+	return err
+}
+
+// GetProgress returns an empty progress for folders that were never processed
+func (rep *Repository) GetProgress(email string, folder string) (FolderProgress, error) {
+	var getProgress = `SELECT uid_validity, last_uid FROM folder_progress WHERE
+	email=:email AND folder=:folder;`
+	row := rep.conn.QueryRow(getProgress, sql.Named("email", email), sql.Named("folder", folder))
+
+	p := FolderProgress{Email: email, Folder: folder}
+	err := row.Scan(&(p.UidValidity), &(p.LastUid))
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, nil
+	}
+	return p, err
+}
+
+func (rep *Repository) SaveProgress(p *FolderProgress) error {
+	var saveProgress = `INSERT INTO folder_progress (email, folder, uid_validity, last_uid) VALUES
+	(:email, :folder, :uidValidity, :lastUid)
+	ON CONFLICT (email, folder) DO UPDATE SET uid_validity=excluded.uid_validity, last_uid=excluded.last_uid;`
+	_, err := rep.conn.Exec(saveProgress,
+		sql.Named("email", p.Email),
+		sql.Named("folder", p.Folder),
+		sql.Named("uidValidity", p.UidValidity),
+		sql.Named("lastUid", p.LastUid))
+	return err
+}
+
+// GetPendingDeletions returns the folder's pending deletions, the next due
+// first
+func (rep *Repository) GetPendingDeletions(email string, folder string) ([]PendingDeletion, error) {
+	var getDeletions = `SELECT uid_validity, uid, due FROM pending_deletions WHERE
+	email=:email AND folder=:folder ORDER BY due;`
+	rows, err := rep.conn.Query(getDeletions, sql.Named("email", email), sql.Named("folder", folder))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deletions := []PendingDeletion{}
+	for rows.Next() {
+		d, due := PendingDeletion{Email: email, Folder: folder}, int64(0)
+		if err := rows.Scan(&(d.UidValidity), &(d.Uid), &due); err != nil {
+			return nil, err
+		}
+		d.Due = time.UnixMilli(due)
+		deletions = append(deletions, d)
+	}
+	return deletions, rows.Err()
+}
+
+func (rep *Repository) AddPendingDeletions(deletions []PendingDeletion) error {
+	var addDeletion = `INSERT INTO pending_deletions (email, folder, uid_validity, uid, due) VALUES
+	(:email, :folder, :uidValidity, :uid, :due)
+	ON CONFLICT (email, folder, uid_validity, uid) DO UPDATE SET due=excluded.due;`
+	return rep.execDeletions(addDeletion, deletions)
+}
+
+func (rep *Repository) RemovePendingDeletions(deletions []PendingDeletion) error {
+	var removeDeletion = `DELETE FROM pending_deletions WHERE
+	email=:email AND folder=:folder AND uid_validity=:uidValidity AND uid=:uid;`
+	return rep.execDeletions(removeDeletion, deletions)
+}
+
+// RemoveStaleDeletions forgets the folder's deletions from before its
+// UIDVALIDITY changed, their UIDs may belong to other emails by now
+func (rep *Repository) RemoveStaleDeletions(email string, folder string, uidValidity uint32) error {
+	var removeStale = `DELETE FROM pending_deletions WHERE
+	email=:email AND folder=:folder AND uid_validity!=:uidValidity;`
+	_, err := rep.conn.Exec(removeStale,
+		sql.Named("email", email),
+		sql.Named("folder", folder),
+		sql.Named("uidValidity", uidValidity))
+	return err
+}
+
+// execDeletions runs query once per deletion, all or none of them
+func (rep *Repository) execDeletions(query string, deletions []PendingDeletion) error {
+	tx, err := rep.conn.Begin()
+	if err != nil {
+		return err
+	}
+	for _, d := range deletions {
+		_, err = tx.Exec(query,
+			sql.Named("email", d.Email),
+			sql.Named("folder", d.Folder),
+			sql.Named("uidValidity", d.UidValidity),
+			sql.Named("uid", d.Uid),
+			sql.Named("due", d.Due.UnixMilli()))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetSeenCodes returns at most limit codes seen since the given time, oldest
+// first
+func (rep *Repository) GetSeenCodes(since time.Time, limit int) ([]SeenCode, error) {
+	var getSeen = `SELECT key, seen_at FROM (SELECT key, seen_at FROM seen_codes
+	WHERE seen_at >= :since ORDER BY seen_at DESC LIMIT :limit) ORDER BY seen_at;`
+	rows, err := rep.conn.Query(getSeen, sql.Named("since", since.UnixMilli()), sql.Named("limit", limit))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := []SeenCode{}
+	for rows.Next() {
+		sc, seenAt := SeenCode{}, int64(0)
+		if err := rows.Scan(&(sc.Key), &seenAt); err != nil {
+			return nil, err
+		}
+		sc.SeenAt = time.UnixMilli(seenAt)
+		seen = append(seen, sc)
+	}
+	return seen, rows.Err()
+}
+
+// AddSeenCode remembers a code and forgets the ones seen before the given
+// time, or beyond the newest keep
+func (rep *Repository) AddSeenCode(sc *SeenCode, since time.Time, keep int) error {
+	var addSeen = `INSERT INTO seen_codes (key, seen_at) VALUES (:key, :seenAt)
+	ON CONFLICT (key) DO UPDATE SET seen_at=excluded.seen_at;`
+	var pruneSeen = `DELETE FROM seen_codes WHERE seen_at < :since OR key NOT IN
+	(SELECT key FROM seen_codes ORDER BY seen_at DESC LIMIT :keep);`
+	if _, err := rep.conn.Exec(addSeen, sql.Named("key", sc.Key), sql.Named("seenAt", sc.SeenAt.UnixMilli())); err != nil {
+		return err
+	}
+	_, err := rep.conn.Exec(pruneSeen, sql.Named("since", since.UnixMilli()), sql.Named("keep", keep))
 	return err
 }
 
 func (rep *Repository) GetMailbox(email string) (Mailbox, error) {
-	var getMailbox = "SELECT email, password, server, port, usessl FROM mailboxes WHERE email=:email;"
+	var getMailbox = "SELECT " + mailboxColumns + " FROM mailboxes WHERE email=:email;"
 	row := rep.conn.QueryRow(getMailbox, sql.Named("email", email))
 
-	m := Mailbox{}
-	err := row.Scan(&(m.Email), &(m.Password), &(m.Server), &(m.Port), &(m.UseSSL))
+	m, err := scanMailbox(row)
 	if err != nil {
 		return Mailbox{}, err
 	}
@@ -121,8 +423,34 @@ func (rep *Repository) GetMailbox(email string) (Mailbox, error) {
 
 func (mb Mailbox) ToString() string {
 	protocol := "imap"
-	if mb.UseSSL {
+	if mb.TLS.Mode == TLSImplicit {
 		protocol = "imaps"
 	}
-	return fmt.Sprintf("email: %s\npassword: %s\nserver: %s://%s:%d\n\n", mb.Email, mb.Password, protocol, mb.Server, mb.Port)
+	tlsInfo := mb.TLS.Mode.ToString()
+	if mb.TLS.CAFile != "" {
+		tlsInfo += ", ca " + mb.TLS.CAFile
+	}
+	if len(mb.TLS.Pins) > 0 {
+		tlsInfo += fmt.Sprintf(", %d pins", len(mb.TLS.Pins))
+	}
+	if mb.TLS.MinVersion != 0 {
+		tlsInfo += ", at least " + tlsVersionString(mb.TLS.MinVersion)
+	}
+	if mb.TLS.ClientCert != "" {
+		tlsInfo += ", client cert " + mb.TLS.ClientCert
+	}
+	folders := "INBOX"
+	if len(mb.Folders) > 0 {
+		folders = strings.Join(mb.Folders, ", ")
+	}
+	actions := "none"
+	if len(mb.Actions) > 0 {
+		actions = strings.Join(postActionStrings(mb.Actions), ", ")
+	}
+	// Refresh tokens are never shown
+	credentials := "password: " + mb.Password
+	if mb.OAuthProvider != "" {
+		credentials = "oauth2: " + mb.OAuthProvider
+	}
+	return fmt.Sprintf("email: %s\n%s\nserver: %s://%s:%d\ntls: %s\nfolders: %s\nactions: %s\n\n", mb.Email, credentials, protocol, mb.Server, mb.Port, tlsInfo, folders, actions)
 }
@@ -0,0 +1,181 @@
+package mailwatcher
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// How the connection to a mailbox's server is secured
+type TLSMode int32
+
+const (
+	// TLS from the start, usually on port 993
+	TLSImplicit TLSMode = 0
+	// Plaintext upgraded with STARTTLS, usually on port 143. Servers that don't
+	// offer STARTTLS are never used without TLS.
+	TLSStartTLS TLSMode = 1
+	// No TLS at all, only if asked for explicitly
+	TLSPlaintext TLSMode = 2
+)
+
+type TLSOptions struct {
+	Mode TLSMode
+	// PEM bundle of the CAs to trust instead of the system's
+	CAFile string
+	// SHA-256 fingerprints of certificates, one of which has to be in the
+	// server's verified chain
+	Pins []string
+	// Zero leaves it to Go, which uses TLS 1.2
+	MinVersion uint16
+	// PEM files of a client certificate and its key. The key may be in the
+	// certificate's file.
+	ClientCert string
+	ClientKey  string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func ParseTLSMode(mode string) (TLSMode, error) {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", "implicit":
+		return TLSImplicit, nil
+	case "starttls":
+		return TLSStartTLS, nil
+	case "plaintext":
+		return TLSPlaintext, nil
+	default:
+		return TLSImplicit, fmt.Errorf("unknown tls mode '%s', must be implicit, starttls or plaintext", mode)
+	}
+}
+
+func (m TLSMode) ToString() string {
+	switch m {
+	case TLSStartTLS:
+		return "starttls"
+	case TLSPlaintext:
+		return "plaintext"
+	default:
+		return "implicit"
+	}
+}
+
+// ParseTLSVersion parses versions like "1.2". An empty version is zero.
+func ParseTLSVersion(version string) (uint16, error) {
+	version = strings.TrimSpace(version)
+	if version == "" {
+		return 0, nil
+	}
+	if v, ok := tlsVersions[version]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown tls version '%s', must be 1.0, 1.1, 1.2 or 1.3", version)
+}
+
+func tlsVersionString(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return name
+		}
+	}
+	return ""
+}
+
+// ParseTLSPin accepts fingerprints like openssl x509 -fingerprint -sha256
+// prints them, with or without colons, and returns them in lower case hex
+func ParseTLSPin(pin string) (string, error) {
+	pin = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(pin), "sha256:"))
+	pin = strings.ReplaceAll(pin, ":", "")
+	if b, err := hex.DecodeString(pin); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid sha256 certificate fingerprint '%s'", pin)
+	}
+	return pin, nil
+}
+
+// CheckTLS loads the files a mailbox's TLS options refer to, so that mistakes
+// show up when the mailbox is added rather than when it connects
+func CheckTLS(mb *Mailbox) error {
+	_, err := tlsConfig(mb)
+	return err
+}
+
+// tlsConfig reads the files on every call, so that renewed certificates are
+// picked up on reconnect
+func tlsConfig(mb *Mailbox) (*tls.Config, error) {
+	opts := &mb.TLS
+	config := &tls.Config{ServerName: mb.Server, MinVersion: opts.MinVersion}
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA file %s", opts.CAFile)
+		}
+	}
+
+	if opts.ClientCert != "" {
+		key := opts.ClientKey
+		if key == "" {
+			key = opts.ClientCert
+		}
+		cert, err := tls.LoadX509KeyPair(opts.ClientCert, key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	} else if opts.ClientKey != "" {
+		return nil, errors.New("a client key needs a client certificate")
+	}
+
+	if len(opts.Pins) > 0 {
+		pins := map[string]bool{}
+		for _, p := range opts.Pins {
+			pin, err := ParseTLSPin(p)
+			if err != nil {
+				return nil, err
+			}
+			pins[pin] = true
+		}
+		// Runs after the chain was verified, so any certificate in it will do
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, chain := range cs.VerifiedChains {
+				for _, cert := range chain {
+					sum := sha256.Sum256(cert.Raw)
+					if pins[hex.EncodeToString(sum[:])] {
+						return nil
+					}
+				}
+			}
+			return errors.New("tls: none of the server's certificates is pinned")
+		}
+	}
+	return config, nil
+}
+
+// startTLS never falls back to plaintext. A server that doesn't offer
+// STARTTLS won't start offering it on reconnect, so that is permanent.
+func startTLS(c *client.Client, config *tls.Config) error {
+	ok, err := c.SupportStartTLS()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &permanentError{errors.New("the server doesn't support STARTTLS")}
+	}
+	return c.StartTLS(config)
+}
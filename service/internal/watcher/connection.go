@@ -0,0 +1,90 @@
+package watcher
+
+import (
+	"errors"
+	"log"
+	"mailcode/service/internal/mailwatcher"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Frames waiting to be written to a connection. A client that lets more
+	// pile up has stopped reading and is dropped.
+	outboundQueueSize = 256
+	writeTimeout      = 10 * time.Second
+)
+
+// connection is a client that completed the handshake. sub is guarded by
+// Server.mux. Everything sent to the client goes through its queue, so that
+// the server never blocks on a client that stopped reading.
+type connection struct {
+	net.Conn
+	sub       *subscription
+	out       chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnection(c net.Conn) *connection {
+	conn := &connection{
+		Conn: c,
+		out:  make(chan []byte, outboundQueueSize),
+		done: make(chan struct{}),
+	}
+	go conn.writeLoop()
+	return conn
+}
+
+func (conn *connection) writeLoop() {
+	for {
+		select {
+		case <-conn.done:
+			return
+		case frame := <-conn.out:
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if _, err := conn.Write(frame); err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Println("write error", err)
+				}
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// send queues msg without blocking. It closes the connection and returns
+// false if the client fell too far behind.
+func (conn *connection) send(msg *mailwatcher.Message) bool {
+	frame, err := mailwatcher.Frame(msg)
+	if err != nil {
+		log.Println(err)
+		return true
+	}
+	return conn.sendFrame(frame)
+}
+
+func (conn *connection) sendFrame(frame []byte) bool {
+	select {
+	case <-conn.done:
+		return false
+	case conn.out <- frame:
+		return true
+	default:
+		log.Println("Connection stopped reading, closing it")
+		conn.Close()
+		return false
+	}
+}
+
+// Close also stops the writer. Frames still queued are dropped.
+func (conn *connection) Close() error {
+	var err error
+	conn.closeOnce.Do(func() {
+		close(conn.done)
+		err = conn.Conn.Close()
+	})
+	return err
+}
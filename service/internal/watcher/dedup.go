@@ -0,0 +1,99 @@
+package watcher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"mailcode/service/internal/mailwatcher"
+	"strings"
+	"time"
+)
+
+// codeDedup remembers the codes that were sent, so that an email processed
+// again after a reconnect, found in two folders or forwarded to another
+// watched mailbox doesn't send the same code twice. Emails are told apart by
+// their Message-ID, codes from emails without one are always sent. It isn't
+// safe for concurrent use, only the goroutine forwarding codes uses it.
+type codeDedup struct {
+	ttl  time.Duration
+	size int
+	seen map[string]time.Time
+	// Keys in the order they were seen
+	order []string
+	// Nil unless the codes are kept across restarts
+	repo *mailwatcher.Repository
+}
+
+func newCodeDedup(ttl time.Duration, size int, repo *mailwatcher.Repository) *codeDedup {
+	d := &codeDedup{
+		ttl:  ttl,
+		size: size,
+		seen: map[string]time.Time{},
+		repo: repo,
+	}
+	if repo == nil || !d.enabled() {
+		return d
+	}
+
+	seen, err := repo.GetSeenCodes(time.Now().Add(-ttl), size)
+	if err != nil {
+		log.Println(err)
+		return d
+	}
+	for _, sc := range seen {
+		d.seen[sc.Key] = sc.SeenAt
+		d.order = append(d.order, sc.Key)
+	}
+	return d
+}
+
+func (d *codeDedup) enabled() bool {
+	return d.ttl > 0 && d.size > 0
+}
+
+// firstSeen remembers the code and tells if it wasn't sent before
+func (d *codeDedup) firstSeen(code *mailwatcher.EmailCode, now time.Time) bool {
+	key := dedupKey(code)
+	if key == "" || !d.enabled() {
+		return true
+	}
+
+	for len(d.order) > 0 && now.Sub(d.seen[d.order[0]]) >= d.ttl {
+		d.forgetOldest()
+	}
+	if _, ok := d.seen[key]; ok {
+		return false
+	}
+	if len(d.order) >= d.size {
+		d.forgetOldest()
+	}
+	d.seen[key] = now
+	d.order = append(d.order, key)
+
+	if d.repo != nil {
+		if err := d.repo.AddSeenCode(&mailwatcher.SeenCode{Key: key, SeenAt: now}, now.Add(-d.ttl), d.size); err != nil {
+			log.Println(err)
+		}
+	}
+	return true
+}
+
+func (d *codeDedup) forgetOldest() {
+	delete(d.seen, d.order[0])
+	d.order = d.order[1:]
+}
+
+// dedupKey hashes the Message-ID and the code, so that persisted keys don't
+// give away codes
+func dedupKey(code *mailwatcher.EmailCode) string {
+	id := strings.ToLower(strings.Trim(code.MessageID, "<> "))
+	if id == "" {
+		return ""
+	}
+	value := "code:" + code.Code
+	if code.IsLink() {
+		value = "link:" + code.Link
+	}
+	sum := sha256.Sum256([]byte(id + "\n" + value))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,52 @@
+package watcher
+
+import (
+	"mailcode/service/internal/mailwatcher"
+	"time"
+)
+
+type recentCode struct {
+	code       mailwatcher.EmailCode
+	receivedAt time.Time
+}
+
+// recentCodes is a ring buffer of the last extracted codes. It isn't safe for
+// concurrent use, the server guards it together with its connections.
+type recentCodes struct {
+	ttl   time.Duration
+	codes []recentCode
+	next  int
+	count int
+}
+
+func newRecentCodes(ttl time.Duration, size int) *recentCodes {
+	return &recentCodes{
+		ttl:   ttl,
+		codes: make([]recentCode, size),
+	}
+}
+
+func (r *recentCodes) add(code mailwatcher.EmailCode, now time.Time) {
+	if len(r.codes) == 0 || r.ttl == 0 {
+		return
+	}
+
+	r.codes[r.next] = recentCode{code: code, receivedAt: now}
+	r.next = (r.next + 1) % len(r.codes)
+	if r.count < len(r.codes) {
+		r.count++
+	}
+}
+
+// valid returns the codes that haven't expired yet, oldest first
+func (r *recentCodes) valid(now time.Time) []recentCode {
+	valid := []recentCode{}
+	start := (r.next - r.count + len(r.codes)) % max(len(r.codes), 1)
+	for i := 0; i < r.count; i++ {
+		rc := r.codes[(start+i)%len(r.codes)]
+		if now.Sub(rc.receivedAt) < r.ttl {
+			valid = append(valid, rc)
+		}
+	}
+	return valid
+}
@@ -2,19 +2,29 @@ package watcher
 
 import (
 	"container/list"
+	"encoding/json"
 	"errors"
 	"io"
 	"log"
 	"mailcode/service/internal/mailwatcher"
 	"net"
 	"os"
+	"reflect"
+	"strings"
 	"sync"
+	"time"
 )
 
+const handshakeTimeout = 10 * time.Second
+
+// Returned by handlers that already wrote their reply themselves
+var errReplied = errors.New("reply already sent")
+
 type Server struct {
 	watcher *Watcher
 
 	connections *list.List
+	recent      *recentCodes
 	mux         sync.Mutex
 
 	listener net.Listener
@@ -38,6 +48,7 @@ func NewServer(path string) *Server {
 	s.listener = l
 	s.mux = sync.Mutex{}
 	s.connections = list.New().Init()
+	s.recent = newRecentCodes(0, 0)
 
 	s.wg.Add(1)
 	return s
@@ -46,6 +57,13 @@ func NewServer(path string) *Server {
 func (s *Server) Stop() {
 	close(s.quit)
 	s.listener.Close()
+
+	s.mux.Lock()
+	for el := s.connections.Front(); el != nil; el = el.Next() {
+		el.Value.(*connection).Close()
+	}
+	s.mux.Unlock()
+
 	s.wg.Wait()
 }
 
@@ -64,10 +82,6 @@ func (s *Server) Serve() {
 		} else {
 			s.wg.Add(1)
 
-			s.mux.Lock()
-			s.connections.PushBack(conn)
-			s.mux.Unlock()
-
 			go func() {
 				s.HandleConection(conn)
 				s.wg.Done()
@@ -78,31 +92,251 @@ func (s *Server) Serve() {
 
 func (s *Server) HandleConection(c net.Conn) {
 	defer c.Close()
-	buf := make([]byte, 2048)
+
+	// Connections only receive events once the handshake succeeded
+	if !s.handshake(c) {
+		return
+	}
+	conn := newConnection(c)
+	defer conn.Close()
+	s.mux.Lock()
+	s.connections.PushBack(conn)
+	s.mux.Unlock()
+	defer s.removeConnection(conn)
+
 	for {
-		n, err := c.Read(buf)
-		if err != nil && err != io.EOF {
-			log.Println("read error", err)
-			return
-		}
-		if n == 0 {
-			// Remove c from s.connections
-			s.mux.Lock()
-			for el := s.connections.Front(); el != nil; el = el.Next() {
-				conn := el.Value.(net.Conn)
-				if conn == c {
-					s.connections.Remove(el)
+		msg, err := mailwatcher.ReadMessage(c)
+		if err != nil {
+			if isMalformed(err) {
+				log.Println("Failed to parse received message", err)
+				reply := mailwatcher.NewErrorReply(&msg, mailwatcher.NewError(mailwatcher.ErrInvalidMessage, "%s", err))
+				if !conn.send(&reply) {
+					return
 				}
+				continue
+			}
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Println("read error", err)
 			}
-			s.mux.Unlock()
 			return
 		}
 
-		msg, err := mailwatcher.Parse(buf[:n])
+		if msg.Type != mailwatcher.Request {
+			log.Println("Ignoring message that is not a request")
+			continue
+		}
+
+		var reply mailwatcher.Message
+		var params interface{}
+		switch msg.Cmd {
+		case mailwatcher.Hello:
+			// Already negotiated, repeat what was advertised
+			params = helloReply()
+		case mailwatcher.Subscribe:
+			err = s.subscribe(conn, &msg)
+		case mailwatcher.RecentCodes:
+			params, err = s.recentCodes(conn, &msg)
+		default:
+			params, err = s.watcher.handleMessage(&msg)
+		}
+		if errors.Is(err, errReplied) {
+			continue
+		} else if err != nil {
+			log.Println(err)
+			reply = mailwatcher.NewErrorReply(&msg, err)
+		} else {
+			reply = mailwatcher.NewReply(&msg, params)
+		}
+
+		if !conn.send(&reply) {
+			return
+		}
+	}
+}
+
+// The first message on a connection must be a Hello request stating the
+// client's protocol version. The reply advertises the service's version and
+// the actions it supports, or rejects the client and the connection is closed.
+func (s *Server) handshake(c net.Conn) bool {
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	var reply mailwatcher.Message
+	msg, err := mailwatcher.ReadMessage(c)
+	if err != nil && !isMalformed(err) {
+		if !errors.Is(err, io.EOF) {
+			log.Println("handshake error", err)
+		}
+		return false
+	}
+
+	req := mailwatcher.HelloRequest{}
+	if err != nil {
+		log.Println("handshake error", err)
+		reply = mailwatcher.NewErrorReply(&msg, mailwatcher.NewError(mailwatcher.ErrInvalidMessage, "%s", err))
+	} else if msg.Type != mailwatcher.Request || msg.Cmd != mailwatcher.Hello {
+		reply = mailwatcher.NewErrorReply(&msg, mailwatcher.NewError(mailwatcher.ErrHandshakeRequired, "the first message must be a Hello request"))
+	} else if err := mailwatcher.DecodeRequest(&msg, &req); err != nil {
+		reply = mailwatcher.NewErrorReply(&msg, err)
+	} else if !mailwatcher.IsSupportedVersion(req.Version) {
+		reply = mailwatcher.NewErrorReply(&msg, mailwatcher.NewError(mailwatcher.ErrUnsupportedVersion,
+			"protocol version %d is not supported, the service supports versions %d to %d",
+			req.Version, mailwatcher.MinProtocolVersion, mailwatcher.ProtocolVersion))
+	} else {
+		reply = mailwatcher.NewReply(&msg, helloReply())
+	}
+
+	if err := mailwatcher.WriteMessage(c, &reply); err != nil {
+		log.Println("write error", err)
+		return false
+	}
+	return reply.Error == nil
+}
+
+// isMalformed tells if a frame was read whole but isn't a valid message, so
+// that it can be answered without losing sync with the stream
+func isMalformed(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
+}
+
+func helloReply() mailwatcher.HelloReply {
+	return mailwatcher.HelloReply{
+		Version: mailwatcher.ProtocolVersion,
+		Actions: mailwatcher.SupportedActions(),
+		Events:  mailwatcher.SupportedEvents(),
+	}
+}
+
+// Subscribing replaces the connection's previous filters. The codes that are
+// still valid and match the new filters are replayed right after the reply.
+func (s *Server) subscribe(conn *connection, msg *mailwatcher.Message) error {
+	req := mailwatcher.SubscribeRequest{}
+	if err := mailwatcher.DecodeRequest(msg, &req); err != nil {
+		return err
+	}
+
+	// Holding the lock from queueing the reply until the replay is queued
+	// keeps new codes from being both broadcast and replayed, or from being
+	// missed
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	conn.sub = newSubscription(&req)
+
+	reply := mailwatcher.NewReply(msg, nil)
+	if !conn.send(&reply) {
+		return errReplied
+	}
+
+	for _, rc := range s.recent.valid(time.Now()) {
+		if !conn.sub.matchesCode(&rc.code) {
+			continue
+		}
+		msg, err := codeMessage(&rc.code, true)
 		if err != nil {
-			log.Println("Failed to parse received message")
+			log.Println(err)
+			continue
+		}
+		if !conn.send(&msg) {
+			break
+		}
+	}
+	return errReplied
+}
+
+func (s *Server) recentCodes(conn *connection, msg *mailwatcher.Message) (mailwatcher.RecentCodesReply, error) {
+	reply := mailwatcher.RecentCodesReply{Codes: []mailwatcher.CodeEvent{}, Links: []mailwatcher.LinkEvent{}}
+	req := mailwatcher.RecentCodesRequest{}
+	if err := mailwatcher.DecodeRequest(msg, &req); err != nil {
+		return reply, err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, rc := range s.recent.valid(time.Now()) {
+		if !conn.sub.matchesCode(&rc.code) {
+			continue
+		}
+		if req.Mailbox != "" && !strings.EqualFold(req.Mailbox, rc.code.Mailbox) {
+			continue
+		}
+		if rc.code.IsLink() {
+			reply.Links = append(reply.Links, mailwatcher.NewLinkEvent(&rc.code))
+		} else {
+			reply.Codes = append(reply.Codes, mailwatcher.NewCodeEvent(&rc.code))
+		}
+	}
+	return reply, nil
+}
+
+// codeMessage sends links as Link events and codes as Code events
+func codeMessage(code *mailwatcher.EmailCode, replayed bool) (mailwatcher.Message, error) {
+	if code.IsLink() {
+		ev := mailwatcher.NewLinkEvent(code)
+		ev.Replayed = replayed
+		return mailwatcher.NewEvent(mailwatcher.Link, ev)
+	}
+	ev := mailwatcher.NewCodeEvent(code)
+	ev.Replayed = replayed
+	return mailwatcher.NewEvent(mailwatcher.Code, ev)
+}
+
+// publishCode remembers code for late subscribers and broadcasts it to the
+// connections subscribed to it.
+func (s *Server) publishCode(code mailwatcher.EmailCode) {
+	msg, err := codeMessage(&code, false)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.recent.add(code, time.Now())
+	s.broadcastLocked(&msg, func(sub *subscription) bool {
+		return sub.matchesCode(&code)
+	})
+}
+
+func (s *Server) removeConnection(conn *connection) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for el := s.connections.Front(); el != nil; el = el.Next() {
+		if el.Value.(*connection) == conn {
+			s.connections.Remove(el)
+			return
 		}
+	}
+}
 
-		s.watcher.handleMessage(&msg)
+// broadcast sends msg to every connection whose subscription matches
+func (s *Server) broadcast(msg *mailwatcher.Message, matches func(*subscription) bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.broadcastLocked(msg, matches)
+}
+
+func (s *Server) broadcastLocked(msg *mailwatcher.Message, matches func(*subscription) bool) {
+	frame, err := mailwatcher.Frame(msg)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for el := s.connections.Front(); el != nil; {
+		next := el.Next()
+		conn, ok := el.Value.(*connection)
+		if !ok {
+			log.Panicf("Unexpected type %s in connections list\n", reflect.TypeOf(el.Value))
+		}
+		if !matches(conn.sub) {
+			el = next
+			continue
+		}
+		// Only queued, the lock is never held while writing to a client
+		if !conn.sendFrame(frame) {
+			s.connections.Remove(el)
+		}
+		el = next
 	}
 }
@@ -0,0 +1,80 @@
+package watcher
+
+import (
+	"mailcode/service/internal/mailwatcher"
+	"strings"
+)
+
+// A nil subscription receives every event, like connections that never sent
+// a Subscribe request.
+type subscription struct {
+	mailboxes map[string]bool
+	senders   []string
+	events    map[string]bool
+}
+
+func newSubscription(req *mailwatcher.SubscribeRequest) *subscription {
+	sub := &subscription{
+		mailboxes: map[string]bool{},
+		events:    map[string]bool{},
+	}
+	for _, mb := range req.Mailboxes {
+		sub.mailboxes[strings.ToLower(strings.TrimSpace(mb))] = true
+	}
+	for _, sender := range req.Senders {
+		sub.senders = append(sub.senders, strings.ToLower(strings.TrimSpace(sender)))
+	}
+	for _, ev := range req.Events {
+		sub.events[ev] = true
+	}
+	return sub
+}
+
+func (sub *subscription) wantsEvent(event string) bool {
+	return sub == nil || len(sub.events) == 0 || sub.events[event]
+}
+
+func (sub *subscription) wantsMailbox(mailbox string) bool {
+	return sub == nil || len(sub.mailboxes) == 0 || sub.mailboxes[strings.ToLower(mailbox)]
+}
+
+func (sub *subscription) wantsSender(sender string) bool {
+	if sub == nil || len(sub.senders) == 0 {
+		return true
+	}
+
+	sender = strings.ToLower(sender)
+	domain := sender[strings.LastIndex(sender, "@")+1:]
+	for _, filter := range sub.senders {
+		if strings.Contains(strings.TrimPrefix(filter, "@"), "@") {
+			if filter == sender {
+				return true
+			}
+			continue
+		}
+
+		filter = strings.TrimPrefix(filter, "@")
+		if domain == filter || strings.HasSuffix(domain, "."+filter) {
+			return true
+		}
+	}
+	return false
+}
+
+func (sub *subscription) matchesCode(code *mailwatcher.EmailCode) bool {
+	event := mailwatcher.CodeEvents
+	if code.IsLink() {
+		event = mailwatcher.LinkEvents
+	}
+	return sub.wantsEvent(event) &&
+		sub.wantsMailbox(code.Mailbox) &&
+		sub.wantsSender(code.Sender)
+}
+
+func (sub *subscription) matchesMailboxEvent(ev *mailwatcher.MailboxEvent) bool {
+	event := mailwatcher.StateEvents
+	if ev.Error != "" {
+		event = mailwatcher.ErrorEvents
+	}
+	return sub.wantsEvent(event) && sub.wantsMailbox(ev.Mailbox)
+}
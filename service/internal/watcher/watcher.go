@@ -1,24 +1,25 @@
 package watcher
 
 import (
-	"encoding/json"
 	"errors"
-	"fmt"
 	"log"
 	"mailcode/service/internal/mailwatcher"
-	"net"
 	"os"
 	"os/signal"
-	"reflect"
+	"sync"
 	"syscall"
 	"time"
 )
 
 type Watcher struct {
+	// Guards ctxs, connections are handled concurrently
+	mux         sync.Mutex
 	ctxs        *map[string]*mailwatcher.MailboxContext
 	repo        *mailwatcher.Repository
 	config      *mailwatcher.Configuration
 	codeChannel chan mailwatcher.EmailCode
+	// Mailbox state changes and errors
+	eventChannel chan mailwatcher.MailboxEvent
 }
 
 // Watcher methods
@@ -26,13 +27,14 @@ func (w *Watcher) Run(repo *mailwatcher.Repository, config *mailwatcher.Configur
 
 	codeChannel := make(chan mailwatcher.EmailCode)
 	defer close(codeChannel)
+	eventChannel := make(chan mailwatcher.MailboxEvent)
 	mbs, err := repo.GetAllMailboxes()
 	if err != nil {
 		log.Print(err)
 		return 1
 	}
 
-	mailboxes, err := mailwatcher.WatchMailboxes(mbs, config, codeChannel)
+	mailboxes, err := mailwatcher.WatchMailboxes(mbs, repo, config, codeChannel, eventChannel)
 	if err != nil {
 		log.Print(err)
 		return 1
@@ -42,6 +44,7 @@ func (w *Watcher) Run(repo *mailwatcher.Repository, config *mailwatcher.Configur
 	w.repo = repo
 	w.config = config
 	w.codeChannel = codeChannel
+	w.eventChannel = eventChannel
 
 	// Open UNIX socket, accept connections
 	// Keep connections alive
@@ -50,41 +53,44 @@ func (w *Watcher) Run(repo *mailwatcher.Repository, config *mailwatcher.Configur
 	// When sending a message (Code or Error), broadcast to all connections
 	s := NewServer("/tmp/mailwatcher.sock")
 	s.watcher = w
+	s.recent = newRecentCodes(config.RecentCodesTTL, config.RecentCodesSize)
 	go s.Serve()
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
+	var dedupRepo *mailwatcher.Repository
+	if config.DedupPersist {
+		dedupRepo = repo
+	}
+	dedup := newCodeDedup(config.DedupTTL, config.DedupSize, dedupRepo)
+
 	go func() {
 		for code := range codeChannel {
-			log.Printf("Code is %s\n", code)
-			msg := mailwatcher.Message{
-				Cmd: mailwatcher.Code,
-				Params: map[string]interface{}{
-					"code":   code.Code,
-					"sender": code.Sender,
-				},
+			if !dedup.firstSeen(&code, time.Now()) {
+				log.Printf("Code from %s in %s was already sent\n", code.Sender, code.Mailbox)
+				continue
 			}
+			log.Printf("Code is %v\n", code)
+			s.publishCode(code)
+		}
+	}()
 
-			msgBytes, err := mailwatcher.Serialize(&msg)
-
+	go func() {
+		for ev := range eventChannel {
+			cmd := mailwatcher.StateChanged
+			if ev.Error != "" {
+				cmd = mailwatcher.ConnectionError
+			}
+			msg, err := mailwatcher.NewEvent(cmd, mailwatcher.NewMailboxStateEvent(&ev))
 			if err != nil {
 				log.Println(err)
+				continue
 			}
 
-			s.mux.Lock()
-			for el := s.connections.Front(); el != nil; el = el.Next() {
-				conn, ok := el.Value.(net.Conn)
-				if !ok {
-					log.Panicf("Unexpected type %s in connections list\n", reflect.TypeOf(el.Value))
-				}
-				_, err := conn.Write(msgBytes)
-				if err != nil {
-					log.Println("Failed to send a code to a connection. Removing connection...")
-					s.connections.Remove(el)
-				}
-			}
-			s.mux.Unlock()
+			s.broadcast(&msg, func(sub *subscription) bool {
+				return sub.matchesMailboxEvent(&ev)
+			})
 		}
 	}()
 
@@ -120,41 +126,60 @@ func (w *Watcher) Run(repo *mailwatcher.Repository, config *mailwatcher.Configur
 	return 0
 }
 
-func (w *Watcher) handleMessage(msg *mailwatcher.Message) (*mailwatcher.Message, error) {
+func (w *Watcher) handleMessage(msg *mailwatcher.Message) (interface{}, error) {
 	action, err := msg.Cmd.ToString()
 	if err != nil {
-		return nil, fmt.Errorf("invalid action %d", msg.Cmd)
+		return nil, mailwatcher.NewError(mailwatcher.ErrInvalidAction, "invalid action %d", msg.Cmd)
 	}
 
 	log.Printf("Handling message action %s\n", action)
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
 	switch msg.Cmd {
 	case mailwatcher.Add:
 		// Add email
-		mb, err := map2Mailbox(&msg.Params)
-		if err != nil {
-			return nil, errors.New("failed to parse mailbox from message params")
+		req := mailwatcher.AddRequest{}
+		if err := mailwatcher.DecodeRequest(msg, &req); err != nil {
+			return nil, err
+		}
+		if _, ok := w.config.OAuthProviders[req.OAuthProvider]; req.OAuthProvider != "" && !ok {
+			e := mailwatcher.NewError(mailwatcher.ErrInvalidParams, "invalid params")
+			e.Fields = []mailwatcher.FieldError{{Field: "oauthProvider", Message: "is not configured"}}
+			return nil, e
+		}
+		mb := req.Mailbox()
+		// The files are read by the service, so they are checked here
+		if err := mailwatcher.CheckTLS(&mb); err != nil {
+			e := mailwatcher.NewError(mailwatcher.ErrInvalidParams, "invalid params")
+			e.Fields = []mailwatcher.FieldError{{Field: "tls", Message: err.Error()}}
+			return nil, e
+		}
+		if err := w.repo.AddMailbox(&mb); err != nil {
+			return nil, err
 		}
-		w.repo.AddMailbox(mb)
 	case mailwatcher.Remove:
 		// Remove email
-		em, ok := msg.Params["email"].(string)
-		if !ok {
-			return nil, errors.New("failed to parse email from message params")
+		req := mailwatcher.MailboxRequest{}
+		if err := mailwatcher.DecodeRequest(msg, &req); err != nil {
+			return nil, err
+		}
+		if err := w.repo.RemoveMailbox(req.Email); err != nil {
+			return nil, err
 		}
-		w.repo.RemoveMailbox(em)
 	case mailwatcher.Watch:
 		// Watch email
-		em, ok := msg.Params["email"].(string)
-		if !ok {
-			return nil, errors.New("failed to parse email from message params")
+		req := mailwatcher.MailboxRequest{}
+		if err := mailwatcher.DecodeRequest(msg, &req); err != nil {
+			return nil, err
 		}
-		mb, err := w.repo.GetMailbox(em)
+		mb, err := w.repo.GetMailbox(req.Email)
 		if err != nil {
-			return nil, err
+			return nil, mailwatcher.NewError(mailwatcher.ErrNotFound, "email '%s' not found", req.Email)
 		}
-		ctx, exists := (*w.ctxs)[em]
+		ctx, exists := (*w.ctxs)[req.Email]
 		if !exists || !mailwatcher.IsRunning(ctx) {
-			(*w.ctxs)[em] = mailwatcher.WatchMailbox(&mb, w.config, w.codeChannel)
+			(*w.ctxs)[req.Email] = mailwatcher.WatchMailbox(&mb, w.repo, w.config, w.codeChannel, w.eventChannel)
 		}
 	case mailwatcher.WatchAll:
 		// Start watching all emails
@@ -162,6 +187,9 @@ func (w *Watcher) handleMessage(msg *mailwatcher.Message) (*mailwatcher.Message,
 		// Get all emails from repo
 		// whichever ones aren't in w.ctxs,
 		// add them => go watch() them
+		if err := mailwatcher.DecodeRequest(msg, &mailwatcher.EmptyRequest{}); err != nil {
+			return nil, err
+		}
 		mbs, err := w.repo.GetAllMailboxes()
 		if err != nil {
 			return nil, err
@@ -170,112 +198,97 @@ func (w *Watcher) handleMessage(msg *mailwatcher.Message) (*mailwatcher.Message,
 			mb := el.Value.(*mailwatcher.Mailbox)
 			ctx, exists := (*w.ctxs)[mb.Email]
 			if !exists || !mailwatcher.IsRunning(ctx) {
-				(*w.ctxs)[mb.Email] = mailwatcher.WatchMailbox(mb, w.config, w.codeChannel)
+				(*w.ctxs)[mb.Email] = mailwatcher.WatchMailbox(mb, w.repo, w.config, w.codeChannel, w.eventChannel)
 			}
 		}
 	case mailwatcher.Stop:
 		// Stop watching email
-		em, ok := msg.Params["email"].(string)
-		if !ok {
-			return nil, errors.New("failed to parse email from message params")
+		req := mailwatcher.MailboxRequest{}
+		if err := mailwatcher.DecodeRequest(msg, &req); err != nil {
+			return nil, err
 		}
-		ctx, exists := (*w.ctxs)[em]
+		ctx, exists := (*w.ctxs)[req.Email]
 		if exists {
 			mailwatcher.StopWatchingMailbox(ctx)
-			delete((*w.ctxs), em)
+			delete((*w.ctxs), req.Email)
 		}
 	case mailwatcher.StopAll:
 		// Stop watching all emails. Don't exit
 		//
 		// Signal all the ctxs
 		// clear out the ctxs
+		if err := mailwatcher.DecodeRequest(msg, &mailwatcher.EmptyRequest{}); err != nil {
+			return nil, err
+		}
 		mailwatcher.StopWatchingMailboxes(w.ctxs)
 	case mailwatcher.GetMailbox:
-		em, ok := msg.Params["email"].(string)
-		if !ok {
-			return nil, errors.New("failed to parse email from message params")
+		req := mailwatcher.MailboxRequest{}
+		if err := mailwatcher.DecodeRequest(msg, &req); err != nil {
+			return nil, err
 		}
 
-		mb, err := w.repo.GetMailbox(em)
+		mb, err := w.repo.GetMailbox(req.Email)
 		if err != nil {
-			e := fmt.Sprintf("email '%s' not found", em)
-			return &mailwatcher.Message{
-					Cmd: mailwatcher.GetMailbox,
-					Params: map[string]interface{}{
-						"error": e,
-					},
-				},
-				errors.New(e)
+			return nil, mailwatcher.NewError(mailwatcher.ErrNotFound, "email '%s' not found", req.Email)
 		}
 
-		return &mailwatcher.Message{
-			Cmd:    mailwatcher.GetMailbox,
-			Params: mailbox2map(&mb),
-		}, nil
+		return mailwatcher.NewMailboxInfo(&mb), nil
 	case mailwatcher.GetAllMailboxes:
+		if err := mailwatcher.DecodeRequest(msg, &mailwatcher.EmptyRequest{}); err != nil {
+			return nil, err
+		}
 		mbs, err := w.repo.GetAllMailboxes()
 		if err != nil {
-			e := "error getting emails"
-			return &mailwatcher.Message{
-				Cmd: mailwatcher.GetAllMailboxes,
-				Params: map[string]interface{}{
-					"error": e,
-				},
-			}, errors.New(e)
+			return nil, errors.New("error getting emails")
+		}
+
+		list := mailwatcher.MailboxList{Emails: []mailwatcher.MailboxInfo{}}
+		for el := mbs.Front(); el != nil; el = el.Next() {
+			list.Emails = append(list.Emails, mailwatcher.NewMailboxInfo(el.Value.(*mailwatcher.Mailbox)))
 		}
 
-		return &mailwatcher.Message{
-			Cmd: mailwatcher.GetAllMailboxes,
-			Params: map[string]interface{}{
-				"emails": json.Marshal(),
-			},
-		}, nil
+		return list, nil
+	case mailwatcher.Status:
+		req := mailwatcher.StatusRequest{}
+		if err := mailwatcher.DecodeRequest(msg, &req); err != nil {
+			return nil, err
+		}
+		return w.status(req.Email)
+	default:
+		// Events are only ever sent by the service
+		return nil, mailwatcher.NewError(mailwatcher.ErrInvalidAction, "action %s cannot be requested", action)
 	}
 
 	return nil, nil
 }
 
-func map2Mailbox(mp *map[string]interface{}) (*mailwatcher.Mailbox, error) {
-	if mp == nil {
-		return nil, errors.New("nil pointer to map")
-	}
+// Mailboxes that were never watched or have been stopped are reported as
+// stopped, so every mailbox in the repository shows up.
+func (w *Watcher) status(email string) (mailwatcher.StatusReply, error) {
+	reply := mailwatcher.StatusReply{Mailboxes: []mailwatcher.MailboxStatusInfo{}}
 
-	errTemplate := "%s not in msg params"
-	em, ok := (*mp)["email"].(string)
-	if !ok {
-		return nil, fmt.Errorf(errTemplate, "email")
-	}
-	pw, ok := (*mp)["password"].(string)
-	if !ok {
-		return nil, fmt.Errorf(errTemplate, "password")
-	}
-	srv, ok := (*mp)["server"].(string)
-	if !ok {
-		return nil, fmt.Errorf(errTemplate, "server")
-	}
-	port, ok := (*mp)["port"].(int32)
-	if !ok {
-		return nil, fmt.Errorf(errTemplate, "port")
-	}
-	useSSL, ok := (*mp)["useSSL"].(bool)
-	if !ok {
-		return nil, fmt.Errorf(errTemplate, "port")
-	}
-	mb := mailwatcher.Mailbox{
-		Email:    em,
-		Password: pw,
-		Server:   srv,
-		Port:     port,
-		UseSSL:   useSSL,
+	emails := []string{}
+	if email != "" {
+		if _, err := w.repo.GetMailbox(email); err != nil {
+			return reply, mailwatcher.NewError(mailwatcher.ErrNotFound, "email '%s' not found", email)
+		}
+		emails = append(emails, email)
+	} else {
+		mbs, err := w.repo.GetAllMailboxes()
+		if err != nil {
+			return reply, errors.New("error getting emails")
+		}
+		for el := mbs.Front(); el != nil; el = el.Next() {
+			emails = append(emails, el.Value.(*mailwatcher.Mailbox).Email)
+		}
 	}
-	return &mb, nil
-}
 
-func mailbox2map(mb *mailwatcher.Mailbox) map[string]interface{} {
-	return map[string]interface{}{
-		"email":  mb.Email,
-		"server": mb.Server,
-		"port":   mb.Port,
-		"useSSL": mb.UseSSL,
+	for _, em := range emails {
+		st := mailwatcher.MailboxStatus{Email: em, State: mailwatcher.Stopped}
+		if ctx, exists := (*w.ctxs)[em]; exists {
+			st = mailwatcher.GetStatus(ctx)
+		}
+		reply.Mailboxes = append(reply.Mailboxes, mailwatcher.NewMailboxStatusInfo(&st))
 	}
+	return reply, nil
 }